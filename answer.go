@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"strings"
+
+	"github.com/arienmalec/alexa-go"
+)
+
+// A scheduleAnswer is the answer to a request independent of how it's presented.
+// The handlers produce a scheduleAnswer, which is then rendered for the channel
+// (e.g. an Alexa response or JSON).
+type scheduleAnswer struct {
+	Speech string `json:"speech"`
+	// SSML is the speech with SSML markup without the speak tags. Speech is used
+	// if this is empty.
+	SSML        string             `json:"-"`
+	CardTitle   string             `json:"cardTitle"`
+	CardBody    string             `json:"cardBody"`
+	Occurrences []answerOccurrence `json:"occurrences,omitempty"`
+	// RelativeDay is the day of the answer relative to today (e.g. tomorrow)
+	RelativeDay string `json:"relativeDay,omitempty"`
+	// Reprompt is set when the answer asks the user a question
+	Reprompt string `json:"reprompt,omitempty"`
+	// PendingIntent is the intent that should handle the answer to the question
+	PendingIntent string `json:"-"`
+}
+
+// An answerOccurrence is the structured form of a serviceOccurrence in an answer
+type answerOccurrence struct {
+	Day     string `json:"day"`     // Format is in 2021-06-22
+	Service string `json:"service"` // The friendly service name (e.g. Yard Waste)
+}
+
+// newAnswer returns a scheduleAnswer with the title and the text, which is used
+// for both the speech and the card body
+func newAnswer(title string, text string) scheduleAnswer {
+	return scheduleAnswer{Speech: text, CardTitle: title, CardBody: text}
+}
+
+// addOccurrences adds the structured form of the occurrences to the answer
+func (a *scheduleAnswer) addOccurrences(occurrences ...serviceOccurrence) {
+	for _, occurrence := range occurrences {
+		a.Occurrences = append(a.Occurrences, answerOccurrence{Day: occurrence.day, Service: occurrence.GetName()})
+	}
+}
+
+// attribution credits the source of the schedule data
+const attribution = "Schedule data from ReCollect."
+
+// addAttribution adds the attribution of the schedule data to the end of the
+// card. The speech is left as is to keep it brief.
+func (a *scheduleAnswer) addAttribution() {
+	if a.CardBody == "" {
+		a.CardBody = attribution
+		return
+	}
+	a.CardBody += "\n\n" + attribution
+}
+
+// toAlexaResponse renders the answer as an Alexa response. The session is kept
+// open if the answer has a reprompt.
+func (a scheduleAnswer) toAlexaResponse() alexa.Response {
+	var response alexa.Response
+	if a.SSML != "" {
+		response = newSSMLResponse(a.CardTitle, a.SSML, a.Speech)
+	} else {
+		response = alexa.NewSimpleResponse(a.CardTitle, a.Speech)
+	}
+	response.Body.Card.Content = a.CardBody
+	if a.Reprompt != "" {
+		response.Body.Reprompt = &alexa.Reprompt{OutputSpeech: alexa.Payload{Type: "PlainText", Text: a.Reprompt}}
+		response.Body.ShouldEndSession = false
+	}
+	if a.PendingIntent != "" {
+		response.SessionAttributes = map[string]interface{}{"pendingIntent": a.PendingIntent}
+	}
+	return response
+}
+
+// toJSON renders the answer as JSON
+func (a scheduleAnswer) toJSON() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// toText renders the answer as plain text for a terminal
+func (a scheduleAnswer) toText() string {
+	return a.Speech
+}
+
+// newSSMLResponse returns an Alexa response like alexa.NewSimpleResponse but
+// with SSML speech. The card has the plain text.
+func newSSMLResponse(title string, ssml string, text string) alexa.Response {
+	response := alexa.NewSimpleResponse(title, text)
+	response.Body.OutputSpeech = &alexa.Payload{Type: "SSML", SSML: wrapSSML(ssml)}
+	return response
+}
+
+// wrapSSML returns the SSML wrapped in the speak tags
+func wrapSSML(ssml string) string {
+	return "<speak>" + ssml + "</speak>"
+}
+
+// strongEmphasis returns the SSML marked up to be spoken with strong emphasis
+func strongEmphasis(ssml string) string {
+	return `<emphasis level="strong">` + ssml + `</emphasis>`
+}
+
+// ssmlListBreaks returns the text escaped for SSML with a short pause after
+// each comma so that lists are spoken naturally
+func ssmlListBreaks(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), ", ", `, <break time="200ms"/>`)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestScheduleAnswerRendering(t *testing.T) {
+	answer := newAnswer("Garbage Curbside Pick Up", "The next garbage pick up is on Monday, June 21, 2021.")
+	answer.CardBody = "Garbage: Mon 6/21"
+	answer.RelativeDay = "tomorrow"
+	answer.addOccurrences(serviceOccurrence{day: "2021-06-21", name: "Garbage"})
+
+	response := answer.toAlexaResponse()
+	if response.Body.OutputSpeech.Type != "PlainText" || response.Body.OutputSpeech.Text != answer.Speech {
+		t.Errorf("unexpected output speech: %+v", response.Body.OutputSpeech)
+	}
+	if response.Body.Card.Title != answer.CardTitle || response.Body.Card.Content != answer.CardBody {
+		t.Errorf("unexpected card: %+v", response.Body.Card)
+	}
+	if !response.Body.ShouldEndSession || response.Body.Reprompt != nil {
+		t.Error("expected the session to end without a reprompt")
+	}
+
+	data, err := answer.toJSON()
+	if err != nil {
+		t.Fatalf("failed to render the answer as JSON: %v", err)
+	}
+
+	var decoded struct {
+		Speech      string
+		CardTitle   string
+		CardBody    string
+		RelativeDay string
+		Occurrences []answerOccurrence
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal the JSON answer %s: %v", data, err)
+	}
+	if decoded.Speech != answer.Speech || decoded.CardTitle != answer.CardTitle || decoded.CardBody != answer.CardBody {
+		t.Errorf("unexpected JSON answer: %s", data)
+	}
+	if decoded.RelativeDay != "tomorrow" {
+		t.Errorf("expected the relative day tomorrow, got %q", decoded.RelativeDay)
+	}
+	expected := answerOccurrence{Day: "2021-06-21", Service: "Garbage"}
+	if len(decoded.Occurrences) != 1 || decoded.Occurrences[0] != expected {
+		t.Errorf("expected the occurrences [%+v], got %+v", expected, decoded.Occurrences)
+	}
+}
+
+func TestScheduleAnswerRenderingReprompt(t *testing.T) {
+	answer := newClarificationAnswer("Frequency", []string{"Leaf Collection", "Yard Waste"})
+	answer.SSML = "Did you mean leaf collection or yard waste?"
+
+	response := answer.toAlexaResponse()
+	if response.Body.OutputSpeech.Type != "SSML" || response.Body.OutputSpeech.SSML != wrapSSML(answer.SSML) {
+		t.Errorf("unexpected output speech: %+v", response.Body.OutputSpeech)
+	}
+	if response.Body.ShouldEndSession || response.Body.Reprompt == nil {
+		t.Fatal("expected the session to stay open with a reprompt")
+	}
+	if response.Body.Reprompt.OutputSpeech.Text != answer.Reprompt {
+		t.Errorf("expected the reprompt %q, got %q", answer.Reprompt, response.Body.Reprompt.OutputSpeech.Text)
+	}
+	if response.SessionAttributes["pendingIntent"] != "Frequency" {
+		t.Errorf("expected the pending intent Frequency, got %v", response.SessionAttributes["pendingIntent"])
+	}
+
+	data, err := answer.toJSON()
+	if err != nil {
+		t.Fatalf("failed to render the answer as JSON: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal the JSON answer %s: %v", data, err)
+	}
+	if decoded["reprompt"] != answer.Reprompt {
+		t.Errorf("expected the JSON reprompt %q, got %v", answer.Reprompt, decoded["reprompt"])
+	}
+	// The SSML and pending intent are specific to Alexa
+	if _, ok := decoded["SSML"]; ok {
+		t.Errorf("expected the JSON answer to not have the SSML: %s", data)
+	}
+	if _, ok := decoded["PendingIntent"]; ok {
+		t.Errorf("expected the JSON answer to not have the pending intent: %s", data)
+	}
+}
+
+func TestSSMLEmphasis(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	// Noon on Monday, June 21, 2021 in Cary
+	setNow(t, time.Date(2021, 6, 21, 16, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		name     string
+		day      string
+		text     string
+		expected string
+	}{
+		{
+			"today", "2021-06-21", "Today, on Monday, June 21, 2021, there will be curb side pick up for: ",
+			`<emphasis level="strong">Today</emphasis>, on Monday, <say-as interpret-as="date">20210621</say-as>, ` +
+				`there will be curb side pick up for: `,
+		},
+		{
+			"tomorrow without the relative day", "2021-06-22", "The next garbage pick up is on Tuesday, June 22, 2021.",
+			`The next garbage pick up is on <emphasis level="strong">Tuesday, ` +
+				`<say-as interpret-as="date">20210622</say-as></emphasis>.`,
+		},
+		{
+			"next week", "2021-06-28", "The next garbage pick up is on Monday, June 28, 2021.",
+			`The next garbage pick up is on Monday, <say-as interpret-as="date">20210628</say-as>.`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			occurrence := serviceOccurrence{day: test.day, name: "Garbage"}
+			if actual := occurrence.ssmlWithDay(test.text); actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// runCLI answers the query for the address and prints the text of the answer to
+// stdout, which allows the handlers to be tried locally without deploying to AWS
+// Lambda. The query is "next" for the WhatIsNext intent or a collection type
+// (e.g. recycling) for the GetSchedule intent.
+func runCLI(ctx context.Context, client httpDoer, address string, query string) error {
+	query = strings.TrimSpace(query)
+	log.Printf("Answering the query %s for the address %s", query, address)
+
+	var answer scheduleAnswer
+	var err error
+	if strings.EqualFold(query, "next") {
+		answer, err = handleWhatIsNext(ctx, client, address)
+	} else {
+		answer, err = handleGetSchedule(ctx, client, address, normalizeServiceType(query))
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(answer.toText())
+	return nil
+}
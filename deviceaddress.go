@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/arienmalec/alexa-go"
+	"github.com/mprahl/cary-curbside-pick-up/recollect"
+)
+
+// addressPermission is the Alexa permission to read the device's full address
+const addressPermission = "read::alexa:device:all:address"
+
+// errAddressPermission is returned when the user hasn't granted the skill
+// permission to read the device's address
+var errAddressPermission = errors.New("the permission to read the device address was not granted")
+
+// A skillRequest is an Alexa request that also has the fields of the request
+// context that alexa.Request doesn't decode. The context replaces the embedded
+// alexa.Request's Context field when decoding.
+type skillRequest struct {
+	alexa.Request
+	DeviceContext deviceContext `json:"context"`
+}
+
+// deviceContext has the fields of the Alexa request context needed to call the
+// Device Address API and to tell what the device supports
+type deviceContext struct {
+	System struct {
+		APIEndpoint    string `json:"apiEndpoint"`
+		APIAccessToken string `json:"apiAccessToken"`
+		Device         struct {
+			DeviceID            string                 `json:"deviceId"`
+			SupportedInterfaces map[string]interface{} `json:"supportedInterfaces"`
+		} `json:"device"`
+	} `json:"System"`
+}
+
+// hasDisplay returns true if the Alexa device has a screen
+func (d deviceContext) hasDisplay() bool {
+	interfaces := d.System.Device.SupportedInterfaces
+	_, hasAPL := interfaces["Alexa.Presentation.APL"]
+	_, hasDisplay := interfaces["Display"]
+	return hasAPL || hasDisplay
+}
+
+// A consentResponse is an Alexa response with a permission consent card, which
+// alexa.Payload can't represent since it has no permissions field
+type consentResponse struct {
+	Version string `json:"version"`
+	Body    struct {
+		OutputSpeech     alexa.Payload `json:"outputSpeech"`
+		Card             consentCard   `json:"card"`
+		ShouldEndSession bool          `json:"shouldEndSession"`
+	} `json:"response"`
+}
+
+// A consentCard is an Alexa card asking the user to grant the permissions
+type consentCard struct {
+	Type        string   `json:"type"`
+	Permissions []string `json:"permissions"`
+}
+
+// newAddressConsentResponse returns an Alexa response asking the user to grant
+// the skill permission to read the device's address in the Alexa app
+func newAddressConsentResponse() consentResponse {
+	var response consentResponse
+	response.Version = "1.0"
+	response.Body.OutputSpeech = alexa.Payload{
+		Type: "PlainText",
+		Text: "To look up your curbside pick up schedule, please enable address access in the Alexa app.",
+	}
+	response.Body.Card = consentCard{Type: "AskForPermissionsConsent", Permissions: []string{addressPermission}}
+	response.Body.ShouldEndSession = true
+	return response
+}
+
+// getAddress returns the street address to look up. The address of the Alexa
+// device is used when available. Otherwise, the STREET_ADDRESS environment
+// variable is used. errAddressPermission is returned if the permission to read
+// the device address wasn't granted or the request has no API access token and
+// STREET_ADDRESS is unset.
+func getAddress(ctx context.Context, client httpDoer, request skillRequest) (string, error) {
+	address, err := getDeviceAddress(ctx, client, request.DeviceContext)
+	if err == nil {
+		return address, nil
+	}
+
+	if streetAddress := os.Getenv("STREET_ADDRESS"); streetAddress != "" {
+		log.Printf("Using the STREET_ADDRESS environment variable since the device address is unavailable: %v", err)
+		return streetAddress, nil
+	}
+
+	if errors.Is(err, errAddressPermission) {
+		return "", err
+	}
+	return "", fmt.Errorf("%w: the device address is unavailable: %v", errNotConfigured, err)
+}
+
+// getDeviceAddress returns the address of the Alexa device from the Alexa Device
+// Address API in the format of "1260 NW Maynard Rd, Cary, NC 27513"
+func getDeviceAddress(ctx context.Context, client httpDoer, deviceCtx deviceContext) (string, error) {
+	system := deviceCtx.System
+	// Without the token, the Device Address API can only fail, so ask the user for
+	// the permission instead
+	if system.APIAccessToken == "" {
+		log.Print("The request doesn't have an API access token to read the device address")
+		return "", errAddressPermission
+	}
+	if system.APIEndpoint == "" || system.Device.DeviceID == "" {
+		return "", errors.New("the request doesn't have the device address API fields")
+	}
+
+	deviceID := url.PathEscape(system.Device.DeviceID)
+	url := fmt.Sprintf("%s/v1/devices/%s/settings/address", strings.TrimSuffix(system.APIEndpoint, "/"), deviceID)
+	log.Printf("Making an HTTP request at %s", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+system.APIAccessToken)
+	resp, err := doWithRetries(client, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the device address: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		log.Print("The permission to read the device address was not granted")
+		return "", errAddressPermission
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("The device address HTTP request failed with %s", resp.Status)
+		return "", fmt.Errorf("failed to get the device address: %s", resp.Status)
+	}
+
+	body, err := recollect.ReadBody(resp)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the device address: %v", err)
+	}
+
+	var deviceAddress struct {
+		AddressLine1  string `json:"addressLine1"`
+		City          string `json:"city"`
+		StateOrRegion string `json:"stateOrRegion"`
+		PostalCode    string `json:"postalCode"`
+	}
+	err = json.Unmarshal(body, &deviceAddress)
+	if err != nil {
+		log.Printf("Failed to unmarshall the device address response: %v", err)
+		return "", fmt.Errorf("failed to unmarshall the response: %v", err)
+	}
+
+	if strings.TrimSpace(deviceAddress.AddressLine1) == "" {
+		return "", errors.New("the device doesn't have a street address")
+	}
+
+	parts := []string{strings.TrimSpace(deviceAddress.AddressLine1)}
+	if city := strings.TrimSpace(deviceAddress.City); city != "" {
+		parts = append(parts, city)
+	}
+	if region := strings.TrimSpace(deviceAddress.StateOrRegion + " " + deviceAddress.PostalCode); region != "" {
+		parts = append(parts, region)
+	}
+	return strings.Join(parts, ", "), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newDeviceRequest returns a WhatIsNext request from a device with the Device
+// Address API endpoint and token
+func newDeviceRequest(apiEndpoint string, apiAccessToken string) skillRequest {
+	request := newIntentRequest("WhatIsNext", nil)
+	request.DeviceContext.System.APIEndpoint = apiEndpoint
+	request.DeviceContext.System.APIAccessToken = apiAccessToken
+	request.DeviceContext.System.Device.DeviceID = "amzn1.ask.device.ABC"
+	return request
+}
+
+func TestMissingAPIAccessToken(t *testing.T) {
+	setenv(t, "STREET_ADDRESS", "")
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected HTTP request to %s", req.URL)
+		return newStatusResponse(http.StatusUnauthorized), nil
+	})
+
+	response, err := intentDispatcher(context.Background(), client, newDeviceRequest("https://api.amazonalexa.com", ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	consent, ok := response.(consentResponse)
+	if !ok {
+		t.Fatalf("expected the permission consent response, got %+v", response)
+	}
+	if consent.Body.Card.Type != "AskForPermissionsConsent" || consent.Body.Card.Permissions[0] != addressPermission {
+		t.Errorf("unexpected consent card: %+v", consent.Body.Card)
+	}
+}
+
+func TestGetAddress(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		status        int
+		streetAddress string
+		expected      string
+		err           error
+	}{
+		{"device address", "token", http.StatusOK, "", "1260 NW Maynard Rd, Cary, NC 27513", nil},
+		{"permission not granted", "token", http.StatusForbidden, "", "", errAddressPermission},
+		{"missing token", "", http.StatusOK, "", "", errAddressPermission},
+		{"missing token with STREET_ADDRESS", "", http.StatusOK, "316 N Academy St", "316 N Academy St", nil},
+		{"server error", "token", http.StatusNotFound, "", "", errNotConfigured},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "STREET_ADDRESS", test.streetAddress)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/devices/amzn1.ask.device.ABC/settings/address" {
+					t.Errorf("unexpected path %s", r.URL.Path)
+				}
+				if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+					t.Errorf("unexpected authorization header %q", auth)
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(`{"addressLine1": "1260 NW Maynard Rd", "city": "Cary", "stateOrRegion": "NC", "postalCode": "27513"}`))
+			}))
+			defer server.Close()
+
+			address, err := getAddress(context.Background(), server.Client(), newDeviceRequest(server.URL, test.token))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected the error %v, got %v", test.err, err)
+			}
+			if address != test.expected {
+				t.Errorf("expected the address %q, got %q", test.expected, address)
+			}
+		})
+	}
+}
@@ -5,4 +5,5 @@ go 1.16
 require (
 	github.com/arienmalec/alexa-go v0.0.0-20181025212142-975687393e90 // indirect
 	github.com/aws/aws-lambda-go v1.24.0 // indirect
+	golang.org/x/sync v0.1.0
 )
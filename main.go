@@ -1,31 +1,53 @@
 // Package main is an AWS Lambda function to get the curbside pick up
-// services for your Cary home. The input must be an Alexa request. To use this,
-// set the "STREET_ADDRESS" to your home's street address
-// (e.g. 1260 NW Maynard Rd).
+// services for your Cary home. The input must be an Alexa request. The address
+// of the Alexa device is used when the user grants permission to read it.
+// Otherwise, set the "STREET_ADDRESS" to your home's street address
+// (e.g. 1260 NW Maynard Rd). For local testing, the -address and -query flags
+// answer a query without AWS Lambda.
 package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"html"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	// Embed the time zone database since the Lambda runtime may not have it
+	_ "time/tzdata"
 
 	"github.com/arienmalec/alexa-go"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/mprahl/cary-curbside-pick-up/recollect"
+	"golang.org/x/sync/singleflight"
 )
 
+const (
+	// unknownDayPhrase is spoken in place of an occurrence day that can't be
+	// parsed
+	unknownDayPhrase = "an unspecified upcoming day"
+)
+
+// httpDoer sends HTTP requests. This is satisfied by *http.Client and allows
+// the recollect API to be replaced in tests.
+type httpDoer = recollect.Doer
+
 // A serviceOccurrence represents a curbside pick up service on a specific day
 type serviceOccurrence struct {
-	day  string // Format is in 2021-06-22
-	name string // Typical values are Garbage, Recycling, yardwaste, and looseleaf
+	day   string // Format is in 2021-06-22
+	name  string // Typical values are Garbage, Recycling, yardwaste, and looseleaf
+	title string // The optional recollect event title (e.g. Leaf collection - final pass)
 }
 
 // GetName returns the friendly name of the service occurrence
@@ -38,215 +60,2542 @@ func (s serviceOccurrence) GetName() string {
 	return s.name
 }
 
-// GetFormatted Day returns the friendly day of the occurrence in the format of
-// Monday, January 2, 2006
+// key returns the day and the case insensitive name of the occurrence, which
+// identifies duplicate occurrences
+func (s serviceOccurrence) key() string {
+	return s.day + "/" + strings.ToLower(strings.TrimSpace(s.name))
+}
+
+// GetFormatted Day returns the friendly day of the occurrence as it should be
+// spoken. This is in the format set with the SPEECH_DATE_FORMAT environment
+// variable and defaults to Monday, January 2, 2006.
 func (s serviceOccurrence) GetFormattedDay() string {
-	t, _ := time.Parse("2006-01-02", s.day)
-	return t.Format("Monday, January 2, 2006")
+	return s.formatDay(getDateFormat("SPEECH_DATE_FORMAT", "full"))
+}
+
+// GetSpokenDay returns the day of the occurrence as it should be spoken after a
+// verb (e.g. "on Monday, January 2, 2006"). If the DATE_PHRASING environment
+// variable is "combined", a pick up today or tomorrow is spoken with both the
+// relative and absolute day (e.g. "tomorrow, Monday, January 2, 2006").
+func (s serviceOccurrence) GetSpokenDay() string {
+	formattedDay := s.GetFormattedDay()
+	if strings.ToLower(os.Getenv("DATE_PHRASING")) == "combined" {
+		if dayPhrase := relativeDayPhrase(s.day); dayPhrase == "today" || dayPhrase == "tomorrow" {
+			return fmt.Sprintf("%s, %s", dayPhrase, formattedDay)
+		}
+	}
+	return "on " + formattedDay
+}
+
+// GetListDay returns the day of the occurrence as it should be spoken in a list
+// of days without commas (e.g. Monday June 21)
+func (s serviceOccurrence) GetListDay() string {
+	t, err := time.Parse("2006-01-02", s.day)
+	if err != nil {
+		log.Printf("Failed to parse the day %s of the %s service: %v", s.day, s.name, err)
+		return unknownDayPhrase
+	}
+	return t.Format("Monday January 2")
+}
+
+// GetSSMLDay returns the SSML of GetFormattedDay where the date is marked up to
+// be pronounced as a date (e.g. Monday, <say-as interpret-as="date">20060102</say-as>).
+// A pick up today or tomorrow is strongly emphasized since it's time sensitive.
+func (s serviceOccurrence) GetSSMLDay() string {
+	if s.isTodayOrTomorrow() {
+		return strongEmphasis(s.ssmlDate())
+	}
+	return s.ssmlDate()
+}
+
+// ssmlDate returns GetSSMLDay without the emphasis
+func (s serviceOccurrence) ssmlDate() string {
+	t, err := time.Parse("2006-01-02", s.day)
+	if err != nil {
+		return html.EscapeString(s.GetFormattedDay())
+	}
+
+	date := t.Format("20060102")
+	if getDateFormat("SPEECH_DATE_FORMAT", "full") != "full" {
+		// Question marks leave out the year
+		date = t.Format("????0102")
+	}
+	return fmt.Sprintf(`%s, <say-as interpret-as="date">%s</say-as>`, t.Format("Monday"), date)
+}
+
+// ssmlWithDay returns the text escaped for SSML where the first GetFormattedDay
+// of the occurrence is replaced with GetSSMLDay. If the text says the pick up is
+// today or tomorrow, those words are emphasized rather than the date.
+func (s serviceOccurrence) ssmlWithDay(text string) string {
+	ssml := html.EscapeString(text)
+	formattedDay := html.EscapeString(s.GetFormattedDay())
+	if s.isTodayOrTomorrow() {
+		dayPhrase := relativeDayPhrase(s.day)
+		if i := strings.Index(strings.ToLower(ssml), dayPhrase); i != -1 {
+			end := i + len(dayPhrase)
+			ssml = ssml[:i] + strongEmphasis(ssml[i:end]) + ssml[end:]
+			return strings.Replace(ssml, formattedDay, s.ssmlDate(), 1)
+		}
+	}
+	return strings.Replace(ssml, formattedDay, s.GetSSMLDay(), 1)
+}
+
+// isTodayOrTomorrow returns true if the occurrence is phrased as today or
+// tomorrow by relativeDayPhrase
+func (s serviceOccurrence) isTodayOrTomorrow() bool {
+	dayPhrase := relativeDayPhrase(s.day)
+	return dayPhrase == "today" || dayPhrase == "tomorrow"
+}
+
+// GetCardDay returns the day of the occurrence as it should be displayed on
+// cards. This is in the format set with the CARD_DATE_FORMAT environment
+// variable. It defaults to the compact format of Mon 1/2 if the
+// COMPACT_CARD_DATES environment variable is true, otherwise it's the same as
+// GetFormattedDay.
+func (s serviceOccurrence) GetCardDay() string {
+	defaultFormat := "compact"
+	if !getBoolEnv("COMPACT_CARD_DATES") {
+		defaultFormat = getDateFormat("SPEECH_DATE_FORMAT", "full")
+	}
+	return s.formatDay(getDateFormat("CARD_DATE_FORMAT", defaultFormat))
+}
+
+// formatDay returns the day of the occurrence in the named date format from
+// dateFormats
+func (s serviceOccurrence) formatDay(format string) string {
+	t, err := time.ParseInLocation("2006-01-02", s.day, getLocation())
+	if err != nil {
+		log.Printf("Failed to parse the day %s of the %s service: %v", s.day, s.name, err)
+		return unknownDayPhrase
+	}
+	return t.Format(dateFormats[format])
+}
+
+// dateFormats are the time layouts of the named date formats that can be set
+// with the SPEECH_DATE_FORMAT and CARD_DATE_FORMAT environment variables
+var dateFormats = map[string]string{
+	"full":    "Monday, January 2, 2006",
+	"no-year": "Monday, January 2",
+	"compact": "Mon 1/2",
+}
+
+// getDateFormat returns the named date format from dateFormats set with the
+// environment variable. The default format is returned if the environment
+// variable is unset or isn't a known format.
+func getDateFormat(name string, defaultFormat string) string {
+	format := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	if format == "" {
+		return defaultFormat
+	}
+	if _, ok := dateFormats[format]; !ok {
+		log.Printf("The %s environment variable is not a known date format, so using %s", name, defaultFormat)
+		return defaultFormat
+	}
+	return format
+}
+
+// GetMonthDay returns the short friendly day of the occurrence in the format of
+// January 2
+func (s serviceOccurrence) GetMonthDay() string {
+	t, err := time.Parse("2006-01-02", s.day)
+	if err != nil {
+		log.Printf("Failed to parse the day %s of the %s service: %v", s.day, s.name, err)
+		return unknownDayPhrase
+	}
+	return t.Format("January 2")
 }
 
-// handleGetSchedule handles the GetSchedule intent and returns an Alexa
-// response
-func handleGetSchedule(address string, serviceType string) (alexa.Response, error) {
-	occurrences, err := getThirtyDaySchedule(address)
+// handleGetSchedule handles the GetSchedule intent and returns an answer
+func handleGetSchedule(ctx context.Context, client httpDoer, address string, serviceType string) (scheduleAnswer, error) {
+	if answer, ok := checkServiceType("GetSchedule", serviceType); ok {
+		return answer, nil
+	}
+
+	if msg, ok := getOffSeasonMessage(serviceType, localNow()); ok {
+		title := fmt.Sprintf("%v Curbside Pick Up", serviceType)
+		return newAnswer(title, msg), nil
+	}
+
+	occurrences, err := getUpcomingSchedule(ctx, client, address)
 	if err != nil {
-		return alexa.Response{}, err
+		return scheduleAnswer{}, err
+	}
+
+	serviceName, clarification, ok := resolveServiceType("GetSchedule", serviceType, occurrences)
+	if ok {
+		return clarification, nil
 	}
 
-	serviceTypeLower := strings.ToLower(serviceType)
+	var matches []serviceOccurrence
 	for _, occurrence := range occurrences {
-		if strings.ToLower(occurrence.GetName()) == serviceTypeLower {
-			title := fmt.Sprintf("%v Curbside Pick Up", occurrence.GetName())
-			msg := fmt.Sprintf("Curbside pick up for %s is on %s.", serviceTypeLower, occurrence.GetFormattedDay())
-			return alexa.NewSimpleResponse(title, msg), nil
+		if serviceName != "" && occurrence.GetName() == serviceName {
+			matches = append(matches, occurrence)
+		}
+	}
+
+	if len(matches) == 1 {
+		occurrence := matches[0]
+		msgFormat := "Curbside pick up for %s is %s."
+		// Hint that a seasonal service may continue past the end of the window
+		if isNearWindowEnd(occurrence.day) {
+			log.Printf("The only occurrence of %s is near the end of the window", serviceName)
+			msgFormat = "Curbside pick up for %s is %s, and possibly more after that."
+		}
+		title := fmt.Sprintf("%v Curbside Pick Up", occurrence.GetName())
+		msg := fmt.Sprintf(msgFormat, strings.ToLower(occurrence.GetName()), occurrence.GetSpokenDay())
+		answer := newAnswer(title, msg)
+		answer.SSML = occurrence.ssmlWithDay(msg)
+		answer.CardBody = fmt.Sprintf(msgFormat, strings.ToLower(occurrence.GetName()), "on "+occurrence.GetCardDay())
+		if getBoolEnv("SHOW_EVENT_TITLES") && occurrence.title != "" {
+			answer.CardBody += "\n" + occurrence.title
+		}
+		answer.addOccurrences(occurrence)
+		answer.RelativeDay = relativeDayPhrase(occurrence.day)
+		return answer, nil
+	}
+
+	if len(matches) > 1 {
+		log.Printf("Found %d occurrences of %s", len(matches), serviceName)
+		var spokenDays []string
+		var cardDays []string
+		var eventTitles []string
+		for _, occurrence := range matches {
+			spokenDays = append(spokenDays, occurrence.GetListDay())
+			cardDays = append(cardDays, occurrence.GetCardDay())
+			eventTitles = appendEventTitle(eventTitles, occurrence.title)
+		}
+
+		const msgFormat = "Curbside pick up for %s is on %s."
+		name := strings.ToLower(serviceName)
+		title := fmt.Sprintf("%v Curbside Pick Up", serviceName)
+		msg := fmt.Sprintf(msgFormat, name, joinServices(spokenDays))
+		answer := newAnswer(title, msg)
+		answer.SSML = ssmlListBreaks(msg)
+		answer.CardBody = strings.Join(cardDays, "\n")
+		if getBoolEnv("SHOW_EVENT_TITLES") && len(eventTitles) != 0 {
+			answer.CardBody += "\n" + strings.Join(eventTitles, "\n")
 		}
+		answer.addOccurrences(matches...)
+		answer.RelativeDay = relativeDayPhrase(matches[0].day)
+		return answer, nil
 	}
 
 	title := fmt.Sprintf("%v Curbside Pick Up", serviceType)
-	msg := fmt.Sprintf("Curbside pick up for %s is not scheduled in the next 30 days.", serviceType)
-	return alexa.NewSimpleResponse(title, msg), nil
+	msg := fmt.Sprintf("Curbside pick up for %s is not scheduled in the next %d days.", serviceType, getLookaheadDays())
+	return newAnswer(title, msg), nil
+}
+
+// appendEventTitle returns the event titles with the title appended unless it's
+// empty or already in the titles. The occurrences of an event with several
+// services share its title, which should only be shown once.
+func appendEventTitle(eventTitles []string, title string) []string {
+	if title == "" {
+		return eventTitles
+	}
+	for _, eventTitle := range eventTitles {
+		if eventTitle == title {
+			return eventTitles
+		}
+	}
+	return append(eventTitles, title)
+}
+
+// getOffSeasonMessage returns a message explaining when the service type runs if
+// it's a seasonal service that is out of season at the time. Seasonal services
+// are configured with the SEASONAL_SERVICES environment variable in the format of
+// "looseleaf=10-1", where the numbers are the first and last months of the
+// season. The second return value is false if the service type is in season or
+// isn't seasonal.
+func getOffSeasonMessage(serviceType string, t time.Time) (string, bool) {
+	serviceTypeLower := strings.ToLower(strings.TrimSpace(serviceType))
+	for _, season := range getListEnv("SEASONAL_SERVICES", nil) {
+		parts := strings.SplitN(season, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("The seasonal service %s is not in the format of name=start-end", season)
+			continue
+		}
+
+		name := serviceOccurrence{name: strings.TrimSpace(parts[0])}.GetName()
+		if strings.ToLower(name) != serviceTypeLower && strings.ToLower(strings.TrimSpace(parts[0])) != serviceTypeLower {
+			continue
+		}
+
+		var startMonth, endMonth time.Month
+		_, err := fmt.Sscanf(strings.TrimSpace(parts[1]), "%d-%d", &startMonth, &endMonth)
+		if err != nil || startMonth < time.January || startMonth > time.December ||
+			endMonth < time.January || endMonth > time.December {
+			log.Printf("The seasonal service %s has invalid months", season)
+			continue
+		}
+
+		month := t.Month()
+		inSeason := month >= startMonth && month <= endMonth
+		if startMonth > endMonth {
+			// The season wraps around the end of the year
+			inSeason = month >= startMonth || month <= endMonth
+		}
+		if inSeason {
+			return "", false
+		}
+
+		log.Printf("The service %s is out of season", name)
+		msg := fmt.Sprintf("%s runs only from %s through %s.", name, startMonth, endMonth)
+		return msg, true
+	}
+
+	return "", false
+}
+
+// isLeafOrYardWaste returns true if the service type could mean either leaf
+// collection or yard waste, which residents commonly conflate. Use
+// getLeafAndYardWasteNames for which of them are configured.
+func isLeafOrYardWaste(serviceType string) bool {
+	switch strings.ToLower(strings.TrimSpace(serviceType)) {
+	case "leaf", "yard", "yard debris", "lawn waste", "green waste":
+		return true
+	default:
+		return false
+	}
+}
+
+// getLeafAndYardWasteNames returns the friendly names of the leaf collection and
+// yard waste services that are configured in getServiceNames
+func getLeafAndYardWasteNames() []string {
+	var serviceNames []string
+	for _, name := range getServiceNames() {
+		switch serviceName := (serviceOccurrence{name: name}).GetName(); serviceName {
+		case "Leaf Collection", "Yard Waste":
+			serviceNames = append(serviceNames, serviceName)
+		}
+	}
+	sort.Strings(serviceNames)
+	return serviceNames
+}
+
+// isNearWindowEnd returns true if the day (e.g. 2021-06-22) is within the last
+// days of the look ahead window. The number of days is set with the
+// WINDOW_END_HINT_DAYS environment variable and defaults to 3.
+func isNearWindowEnd(day string) bool {
+	hintDays := getIntEnv("WINDOW_END_HINT_DAYS", 3)
+	windowEnd := localNow().AddDate(0, 0, getLookaheadDays())
+	return day > windowEnd.AddDate(0, 0, -hintDays).Format("2006-01-02")
+}
+
+// isKnownServiceType returns true if the service type matches one of the
+// configured service names of the area from getServiceNames
+func isKnownServiceType(serviceType string) bool {
+	var services []serviceOccurrence
+	for _, name := range getServiceNames() {
+		services = append(services, serviceOccurrence{name: name})
+	}
+	return len(matchServiceNames(serviceType, services)) != 0
+}
+
+// newUnknownServiceAnswer returns an answer explaining that the
+// service type isn't recognized and lists the configured services
+func newUnknownServiceAnswer(serviceType string) scheduleAnswer {
+	msg := fmt.Sprintf(
+		"I don't recognize the collection type %s. Try %s.", serviceType, joinServicesWithOr(getSpokenServiceNames()),
+	)
+	return newAnswer("Unknown Curbside Pick Up", msg)
+}
+
+// getSpokenServiceNames returns the lower case friendly names of the services
+// from getServiceNames in the configured order
+func getSpokenServiceNames() []string {
+	var serviceNames []string
+	for _, name := range getServiceNames() {
+		serviceNames = append(serviceNames, strings.ToLower(serviceOccurrence{name: name}.GetName()))
+	}
+	return serviceNames
+}
+
+// newClarificationAnswer returns an answer that asks which of the service names
+// was meant and keeps the session open for the answer. The intent name is set
+// as the pending intent so that the answer is handled by the same intent.
+func newClarificationAnswer(intentName string, serviceNames []string) scheduleAnswer {
+	lowerServiceNames := make([]string, len(serviceNames))
+	for i, serviceName := range serviceNames {
+		lowerServiceNames[i] = strings.ToLower(serviceName)
+	}
+
+	msg := fmt.Sprintf("Did you mean %s?", joinServicesWithOr(lowerServiceNames))
+	answer := newAnswer("Which Curbside Pick Up?", msg)
+	answer.Reprompt = msg
+	answer.PendingIntent = intentName
+	return answer
+}
+
+// checkServiceType returns an answer if the service type can't be looked up, so
+// that no HTTP request is made for it. This is a clarification if the service
+// type could be leaf collection or yard waste and both are configured, and an
+// explanation if it isn't a configured service. The second return value is false
+// if the service type can be looked up.
+func checkServiceType(intentName string, serviceType string) (scheduleAnswer, bool) {
+	if isLeafOrYardWaste(serviceType) {
+		if serviceNames := getLeafAndYardWasteNames(); len(serviceNames) > 1 {
+			log.Printf("The service type %s could be leaf collection or yard waste", serviceType)
+			return newClarificationAnswer(intentName, serviceNames), true
+		}
+	}
+
+	if !isKnownServiceType(serviceType) {
+		log.Printf("The service type %s is not a known service", serviceType)
+		return newUnknownServiceAnswer(serviceType), true
+	}
+
+	return scheduleAnswer{}, false
+}
+
+// resolveServiceType returns the friendly service name of the occurrences that
+// the service type refers to, which is empty if none of the occurrences match.
+// If the service type matches more than one service name, a clarification
+// answer is returned instead and the third return value is true.
+func resolveServiceType(intentName string, serviceType string, occurrences []serviceOccurrence) (string, scheduleAnswer, bool) {
+	serviceNames := matchServiceNames(serviceType, occurrences)
+	switch len(serviceNames) {
+	case 0:
+		return "", scheduleAnswer{}, false
+	case 1:
+		return serviceNames[0], scheduleAnswer{}, false
+	default:
+		log.Printf("The service type %s is ambiguous between: %v", serviceType, serviceNames)
+		return "", newClarificationAnswer(intentName, serviceNames), true
+	}
+}
+
+// handleFrequency handles the Frequency intent and returns an answer with how
+// often the service type is picked up
+func handleFrequency(ctx context.Context, client httpDoer, address string, serviceType string) (scheduleAnswer, error) {
+	if answer, ok := checkServiceType("Frequency", serviceType); ok {
+		return answer, nil
+	}
+
+	occurrences, err := getUpcomingSchedule(ctx, client, address)
+	if err != nil {
+		return scheduleAnswer{}, err
+	}
+
+	serviceName, clarification, ok := resolveServiceType("Frequency", serviceType, occurrences)
+	if ok {
+		return clarification, nil
+	}
+
+	if serviceName == "" {
+		title := fmt.Sprintf("%v Curbside Pick Up", serviceType)
+		msg := fmt.Sprintf("Curbside pick up for %s is not scheduled in the next %d days.", serviceType, getLookaheadDays())
+		return newAnswer(title, msg), nil
+	}
+
+	var days []string
+	for _, occurrence := range occurrences {
+		if occurrence.GetName() == serviceName {
+			days = append(days, occurrence.day)
+		}
+	}
+
+	title := fmt.Sprintf("%v Curbside Pick Up", serviceName)
+	var msg string
+	interval := serviceCadence(days)
+	switch {
+	case len(days) == 1:
+		msg = fmt.Sprintf("%s appears once in the next %d days.", serviceName, getLookaheadDays())
+	case interval == 0:
+		msg = fmt.Sprintf(
+			"%s is picked up %s in the next %d days, but not on a regular schedule.",
+			serviceName, timesPhrase(len(days)), getLookaheadDays(),
+		)
+	default:
+		msg = fmt.Sprintf("%s is picked up %s.", serviceName, cadencePhrase(interval))
+	}
+	log.Printf("The service %s has %d occurrences with an interval of %d days", serviceName, len(days), interval)
+
+	answer := newAnswer(title, msg)
+	for _, occurrence := range occurrences {
+		if occurrence.GetName() == serviceName {
+			answer.addOccurrences(occurrence)
+		}
+	}
+	return answer, nil
+}
+
+// serviceCadence returns the number of days between each of the days (e.g.
+// 2021-06-22) in ascending order. This is 0 if there are fewer than two days or
+// the days aren't evenly spaced.
+func serviceCadence(days []string) int {
+	if len(days) < 2 {
+		return 0
+	}
+
+	interval := 0
+	var previous time.Time
+	for i, day := range days {
+		t, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			log.Printf("Failed to parse the day %s: %v", day, err)
+			return 0
+		}
+
+		if i != 0 {
+			gap := int(t.Sub(previous).Hours() / 24)
+			if i == 1 {
+				interval = gap
+			} else if gap != interval {
+				return 0
+			}
+		}
+		previous = t
+	}
+
+	return interval
+}
+
+// cadencePhrase returns how the interval in days between pick ups should be
+// spoken (e.g. "weekly" or "every two weeks")
+func cadencePhrase(interval int) string {
+	switch {
+	case interval == 1:
+		return "daily"
+	case interval == 7:
+		return "weekly"
+	case interval == 14:
+		return "every two weeks"
+	case interval%7 == 0:
+		return fmt.Sprintf("every %d weeks", interval/7)
+	default:
+		return fmt.Sprintf("every %d days", interval)
+	}
+}
+
+// handleServiceWeekday handles the ServiceWeekday intent and returns an answer
+// with the weekday the service type is usually picked up on rather than a date
+func handleServiceWeekday(ctx context.Context, client httpDoer, address string, serviceType string) (scheduleAnswer, error) {
+	if answer, ok := checkServiceType("ServiceWeekday", serviceType); ok {
+		return answer, nil
+	}
+
+	occurrences, err := getUpcomingSchedule(ctx, client, address)
+	if err != nil {
+		return scheduleAnswer{}, err
+	}
+
+	serviceName, clarification, ok := resolveServiceType("ServiceWeekday", serviceType, occurrences)
+	if ok {
+		return clarification, nil
+	}
+
+	if serviceName == "" {
+		title := fmt.Sprintf("%v Curbside Pick Up", serviceType)
+		msg := fmt.Sprintf("Curbside pick up for %s is not scheduled in the next %d days.", serviceType, getLookaheadDays())
+		return newAnswer(title, msg), nil
+	}
+
+	var serviceOccurrences []serviceOccurrence
+	var days []string
+	for _, occurrence := range occurrences {
+		if occurrence.GetName() == serviceName {
+			serviceOccurrences = append(serviceOccurrences, occurrence)
+			days = append(days, occurrence.day)
+		}
+	}
+
+	title := fmt.Sprintf("%v Curbside Pick Up", serviceName)
+	name := strings.ToLower(serviceName)
+	var msg string
+	if weekday, ok := usualWeekday(days); ok && isSameWeekday(days, weekday) {
+		msg = fmt.Sprintf("Your %s is on %ss.", name, weekday)
+	} else {
+		log.Printf("The weekday of the service %s varies", serviceName)
+		if len(days) == 1 {
+			nextDay := relativeDayPhrase(days[0])
+			if nextDay != "today" && nextDay != "tomorrow" {
+				nextDay = "on " + nextDay
+			}
+			msg = fmt.Sprintf("Your %s is only scheduled %s in the next %d days.", name, nextDay, getLookaheadDays())
+		} else {
+			msg = fmt.Sprintf("Your %s varies; the next is %s.", name, serviceOccurrences[0].GetListDay())
+		}
+	}
+
+	answer := newAnswer(title, msg)
+	answer.addOccurrences(serviceOccurrences...)
+	return answer, nil
+}
+
+// isSameWeekday returns true if all the days (e.g. 2021-06-22) fall on the
+// weekday
+func isSameWeekday(days []string, weekday time.Weekday) bool {
+	for _, day := range days {
+		t, err := time.Parse("2006-01-02", day)
+		if err != nil || t.Weekday() != weekday {
+			return false
+		}
+	}
+	return true
+}
+
+// matchServiceNames returns the friendly service names in occurrences that match
+// the requested service type. An exact match (ignoring case and surrounding
+// whitespace) of the friendly or recollect service name is always preferred. Otherwise, all the service names that
+// contain the service type are returned, so more than one returned name means
+// the service type is ambiguous.
+func matchServiceNames(serviceType string, occurrences []serviceOccurrence) []string {
+	serviceTypeLower := strings.ToLower(strings.TrimSpace(serviceType))
+	if serviceTypeLower == "" {
+		return nil
+	}
+
+	var partialMatches []string
+	seen := map[string]bool{}
+	for _, occurrence := range occurrences {
+		name := occurrence.GetName()
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		nameLower := strings.ToLower(name)
+		if nameLower == serviceTypeLower || strings.ToLower(occurrence.name) == serviceTypeLower {
+			return []string{name}
+		}
+		if strings.Contains(nameLower, serviceTypeLower) {
+			partialMatches = append(partialMatches, name)
+		}
+	}
+
+	sort.Strings(partialMatches)
+	return partialMatches
 }
 
-// handleWhatIsNext handles the WhatIsNext intent and returns an Alexa response
-func handleWhatIsNext(address string) (alexa.Response, error) {
-	occurrences, err := getThirtyDaySchedule(address)
+// handleWhatIsNext handles the WhatIsNext intent and returns an answer
+func handleWhatIsNext(ctx context.Context, client httpDoer, address string) (scheduleAnswer, error) {
+	after, before := getLookaheadWindow()
+	occurrences, notices, err := scheduleAndNoticesBetween(ctx, client, address, after, before)
 	if err != nil {
-		return alexa.Response{}, err
+		return scheduleAnswer{}, err
 	}
 
-	var pickUpDate string
+	// In the evening, today's pick up has already happened for most residents
+	eveningMode := isEveningMode(localNow())
+	today := localNow().Format("2006-01-02")
+
+	var pickUpOccurrence serviceOccurrence
 	var serviceNames []string
+	var eventTitles []string
 	// occurrences is ordered by date in ascending order
-	for i, occurrence := range occurrences {
-		if i == 0 {
-			pickUpDate = occurrence.GetFormattedDay()
-		} else if pickUpDate != occurrence.GetFormattedDay() {
+	for _, occurrence := range occurrences {
+		// Skip occurrences without a service name since it's bad data
+		if strings.TrimSpace(occurrence.name) == "" {
+			continue
+		}
+
+		if eveningMode && occurrence.day == today {
+			continue
+		}
+
+		if len(serviceNames) == 0 {
+			pickUpOccurrence = occurrence
+		} else if pickUpOccurrence.day != occurrence.day {
 			// Break when the second scheduled pick up date is encountered
 			break
 		}
 
 		serviceNames = append(serviceNames, occurrence.name)
+		eventTitles = appendEventTitle(eventTitles, occurrence.title)
 	}
 
 	if len(serviceNames) == 0 {
-		log.Print("No curbside pick up is scheduled in the next 30 days")
-		msg := "No curbside pick up is scheduled in the next 30 days."
-		response := alexa.NewSimpleResponse("No Curbside Pick Up", msg)
-		return response, nil
+		msg := fmt.Sprintf("No curbside pick up is scheduled in the next %d days.", getLookaheadDays())
+		log.Print(msg)
+		answer := newAnswer("No Curbside Pick Up", msg)
+		return answer, nil
 	}
 
-	log.Printf("Found %d services on %s", len(serviceNames), pickUpDate)
-	msg := fmt.Sprintf("On %s, there will be curb side pick up for: ", pickUpDate)
+	log.Printf("Found %d services on %s", len(serviceNames), pickUpOccurrence.day)
+	const msgFormat = "%s, there will be curb side pick up for: "
 	sort.Strings(serviceNames)
-	for i, s := range serviceNames {
-		if i != 0 && (i+1) == len(serviceNames) {
-			msg += fmt.Sprintf(", and %s", strings.ToLower(s))
-		} else if i+1 != len(serviceNames) {
-			msg += fmt.Sprintf(", %s", strings.ToLower(s))
-		} else {
-			msg += fmt.Sprintf(" %s.", strings.ToLower(s))
-		}
+	lowerServiceNames := make([]string, len(serviceNames))
+	for i, serviceName := range serviceNames {
+		lowerServiceNames[i] = strings.ToLower(serviceName)
 	}
+	servicesMsg := joinServices(lowerServiceNames) + "."
 
-	return alexa.NewSimpleResponse("Curbside Pick Up Schedule", msg), nil
+	spokenDay := pickUpOccurrence.GetSpokenDay()
+	if eveningMode && relativeDayPhrase(pickUpOccurrence.day) == "tomorrow" {
+		spokenDay = "tomorrow, " + pickUpOccurrence.GetFormattedDay()
+	} else if untilPhrase := daysUntilPhrase(pickUpOccurrence.day); untilPhrase != "" && strings.HasPrefix(spokenDay, "on ") {
+		// Say how soon the pick up is before the date (e.g. "in 2 days, on Monday")
+		spokenDay = untilPhrase + ", " + spokenDay
+	}
+	msg := fmt.Sprintf(msgFormat, capitalize(spokenDay)) + servicesMsg
+	ssml := pickUpOccurrence.ssmlWithDay(fmt.Sprintf(msgFormat, capitalize(spokenDay))) + ssmlListBreaks(servicesMsg)
+	cardContent := fmt.Sprintf(msgFormat, "On "+pickUpOccurrence.GetCardDay()) + servicesMsg
+	if hasAllServices(serviceNames) {
+		log.Printf("All the services are picked up on %s", pickUpOccurrence.day)
+		fullDayMsg := os.Getenv("FULL_DAY_MESSAGE")
+		if fullDayMsg == "" {
+			fullDayMsg = "{day} is a full pick up day with all services."
+		}
+		msg = strings.ReplaceAll(fullDayMsg, "{day}", pickUpOccurrence.GetFormattedDay())
+		ssml = pickUpOccurrence.ssmlWithDay(msg)
+		cardContent = strings.ReplaceAll(fullDayMsg, "{day}", pickUpOccurrence.GetCardDay())
+	} else if getBoolEnv("SAME_AS_USUAL") && isUsualPickUp(occurrences, pickUpOccurrence.day) {
+		log.Printf("The pick up on %s is the same as usual", pickUpOccurrence.day)
+		var friendlyNames []string
+		for _, occurrence := range occurrences {
+			if occurrence.day == pickUpOccurrence.day && strings.TrimSpace(occurrence.name) != "" {
+				friendlyNames = append(friendlyNames, strings.ToLower(occurrence.GetName()))
+			}
+		}
+		sort.Strings(friendlyNames)
+		weekday, _ := time.Parse("2006-01-02", pickUpOccurrence.day)
+		msg = fmt.Sprintf("Same as usual, %s on %s.", joinServices(friendlyNames), weekday.Format("Monday"))
+		ssml = ssmlListBreaks(msg)
+		cardContent = msg + "\n" + cardContent
+	}
+	answer := newAnswer("Curbside Pick Up Schedule", msg)
+	answer.SSML = ssml
+	answer.CardBody = cardContent
+	if getBoolEnv("SHOW_EVENT_TITLES") && len(eventTitles) != 0 {
+		answer.CardBody += "\n" + strings.Join(eventTitles, "\n")
+	}
+	if getBoolEnv("SHOW_NOTICES") {
+		answer.CardBody += formatWeekNotices(notices)
+	}
+	for _, occurrence := range occurrences {
+		if occurrence.day == pickUpOccurrence.day && strings.TrimSpace(occurrence.name) != "" {
+			answer.addOccurrences(occurrence)
+		}
+	}
+	answer.RelativeDay = relativeDayPhrase(pickUpOccurrence.day)
+	return answer, nil
 }
 
-// intentDispatcher handles all incoming Alexa requests and returns an Alexa
-// response
-func intentDispatcher(ctx context.Context, request alexa.Request) (alexa.Response, error) {
-	address := os.Getenv("STREET_ADDRESS")
-	if address == "" {
-		log.Panic("the address is not configured")
+// handleDebugInfo handles the DebugInfo intent and returns an answer with how far
+// ahead recollect has schedule data, which explains why distant queries may not
+// find any pick ups
+func handleDebugInfo(ctx context.Context, client httpDoer, address string) (scheduleAnswer, error) {
+	lastDay, err := getLastScheduledDay(ctx, client, address)
+	if err != nil {
+		return scheduleAnswer{}, err
 	}
-	log.Printf("Using the address %s", address)
 
-	log.Printf("Finding the handler for the intent %s", request.Body.Intent.Name)
-	switch request.Body.Intent.Name {
-	case "GetSchedule":
-		var serviceType string = request.Body.Intent.Slots["collectionType"].Value
-		log.Printf("The GetSchedule intent has the service type %s", serviceType)
-		return handleGetSchedule(address, serviceType)
-	case "WhatIsNext":
-		return handleWhatIsNext(address)
-	case "AMAZON.HelpIntent":
-		const helpMsg string = `You can say things like what's next or when's ` +
-			`recycling. The four supported collection types are: ` +
-			`garbage, recycling, yard waste, and leaf collection.`
-		response := alexa.NewSimpleResponse("Help", helpMsg)
-		return response, nil
-	default:
-		log.Printf("The intent %s was unrecognized", request.Body.Intent.Name)
-		response := alexa.NewSimpleResponse("Unknown Request", "The intent was unrecognized")
-		return response, nil
+	title := "Curbside Pick Up Debug Info"
+	if lastDay == "" {
+		return newAnswer(title, "No schedule data is available."), nil
 	}
+
+	log.Printf("The schedule data is available through %s", lastDay)
+	msg := fmt.Sprintf("Schedule data is available through %s.", serviceOccurrence{day: lastDay}.GetMonthDay())
+	return newAnswer(title, msg), nil
 }
 
-// getAddressID returns the address ID used by the recollect API
-func getAddressID(address string) (string, error) {
-	client := &http.Client{Timeout: 30 * time.Second}
-	addressQS := url.QueryEscape(address)
-	url := fmt.Sprintf("https://api.recollect.net/api/areas/CaryNC/services/1087/address-suggest?q=%s", addressQS)
-	log.Printf("Making an HTTP request at %s", url)
-	resp, err := client.Get(url)
+// handleSeasonInfo handles the SeasonInfo intent and returns an answer with the
+// first and last upcoming days of the service type in the next year, which is
+// meant for seasonal services such as leaf collection
+func handleSeasonInfo(ctx context.Context, client httpDoer, address string, serviceType string) (scheduleAnswer, error) {
+	if answer, ok := checkServiceType("SeasonInfo", serviceType); ok {
+		return answer, nil
+	}
+
+	now := localNow()
+	occurrences, err := scheduleBetween(ctx, client, address, now, now.AddDate(1, 0, 0))
 	if err != nil {
-		return "", err
+		return scheduleAnswer{}, err
+	}
+
+	serviceName, clarification, ok := resolveServiceType("SeasonInfo", serviceType, occurrences)
+	if ok {
+		return clarification, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("The address lookup HTTP request failed with %s", resp.Status)
-		return "", fmt.Errorf("failed to find the address: %s", resp.Status)
+	var serviceOccurrences []serviceOccurrence
+	for _, occurrence := range occurrences {
+		if serviceName != "" && occurrence.GetName() == serviceName {
+			serviceOccurrences = append(serviceOccurrences, occurrence)
+		}
 	}
 
-	type addressItem struct {
-		PlaceID string `json:"place_id"`
+	// At least two days are needed to tell when the season starts and ends
+	if len(serviceOccurrences) < 2 {
+		log.Printf("The service type %s has %d occurrences in the next year", serviceType, len(serviceOccurrences))
+		title := fmt.Sprintf("%v Season", serviceType)
+		msg := fmt.Sprintf("I don't have season info for %s.", strings.ToLower(serviceType))
+		return newAnswer(title, msg), nil
 	}
-	body, err := io.ReadAll(resp.Body)
 
-	if err != nil {
-		return "", fmt.Errorf("failed to find the address: %v", err)
+	first := serviceOccurrences[0]
+	last := serviceOccurrences[len(serviceOccurrences)-1]
+	title := fmt.Sprintf("%v Season", serviceName)
+	msg := fmt.Sprintf("%s runs from %s to %s.", serviceName, first.GetMonthDay(), last.GetMonthDay())
+	answer := newAnswer(title, msg)
+	answer.addOccurrences(first, last)
+	return answer, nil
+}
+
+// handleMissedPickup handles the MissedPickup intent and returns an answer with
+// whether the service type was already picked up this week or is still coming
+// up. The local week starts on the day from getWeekStart.
+func handleMissedPickup(ctx context.Context, client httpDoer, address string, serviceType string) (scheduleAnswer, error) {
+	if answer, ok := checkServiceType("MissedPickup", serviceType); ok {
+		return answer, nil
 	}
 
-	addresses := []addressItem{}
-	err = json.Unmarshal(body, &addresses)
+	now := localNow()
+	weekStart := getWeekStart(now)
+	occurrences, err := scheduleBetween(ctx, client, address, weekStart, weekStart.AddDate(0, 0, 7))
 	if err != nil {
-		log.Printf("Failed to unmarshall the address lookup response: %v", err)
-		return "", fmt.Errorf("failed to unmarshall the response: %v", err)
+		return scheduleAnswer{}, err
+	}
+
+	serviceName, clarification, ok := resolveServiceType("MissedPickup", serviceType, occurrences)
+	if ok {
+		return clarification, nil
+	}
+
+	if serviceName == "" {
+		title := fmt.Sprintf("%v Curbside Pick Up", serviceType)
+		msg := fmt.Sprintf("%s isn't scheduled this week.", capitalize(strings.ToLower(serviceType)))
+		return newAnswer(title, msg), nil
+	}
+
+	// Prefer the next occurrence this week over an occurrence that already passed
+	today := now.Format("2006-01-02")
+	var weekOccurrence serviceOccurrence
+	for _, occurrence := range occurrences {
+		if occurrence.GetName() != serviceName {
+			continue
+		}
+		weekOccurrence = occurrence
+		if occurrence.day >= today {
+			break
+		}
 	}
 
-	if len(addresses) == 0 {
-		log.Printf("The address %s wasn't found", address)
-		return "", errors.New("the address wasn't found")
+	name := strings.ToLower(serviceName)
+	var msg string
+	if weekOccurrence.day < today {
+		weekday := "earlier this week"
+		if t, err := time.Parse("2006-01-02", weekOccurrence.day); err == nil {
+			weekday = t.Format("Monday")
+		} else {
+			log.Printf("Failed to parse the day %s of the %s service: %v", weekOccurrence.day, name, err)
+		}
+		msg = fmt.Sprintf("Yes, %s was collected %s.", name, weekday)
+	} else {
+		msg = fmt.Sprintf("No, %s is still coming up %s.", name, relativeDayPhrase(weekOccurrence.day))
 	}
 
-	// Just return the first found address since it is the most accurrate
-	log.Printf("Found the address ID of %s", addresses[0].PlaceID)
-	return addresses[0].PlaceID, nil
+	answer := newAnswer(fmt.Sprintf("%v Curbside Pick Up", serviceName), msg)
+	answer.addOccurrences(weekOccurrence)
+	return answer, nil
 }
 
-// getThirtyDaySchedule will query the recollect API to find the service
-// occurrences in the next 30 days. This returns a slice of serviceOccurrence
-// instances.
-func getThirtyDaySchedule(address string) ([]serviceOccurrence, error) {
-	addressID, err := getAddressID(address)
+// getLastScheduledDay returns the furthest future day (e.g. 2021-09-15) of the
+// recollect events in the next year, including the notices. This is empty if
+// there are no events.
+func getLastScheduledDay(ctx context.Context, client httpDoer, address string) (string, error) {
+	now := localNow()
+	occurrences, notices, err := scheduleAndNoticesBetween(ctx, client, address, now, now.AddDate(1, 0, 0))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	after := time.Now().Format("2006-01-02")
-	before := time.Now().AddDate(0, 1, 0).Format("2006-01-02")
-	url := fmt.Sprintf("https://api.recollect.net/api/places/%s/services/1087/events?nomerge=1&hide=reminder_only&after=%s&before=%s", addressID, after, before)
-	log.Printf("Making an HTTP request at %s", url)
-	resp, err := client.Get(url)
-	if err != nil {
-		return nil, nil
+	var lastDay string
+	for _, occurrence := range append(occurrences, notices...) {
+		if occurrence.day > lastDay {
+			lastDay = occurrence.day
+		}
 	}
-	defer resp.Body.Close()
+	return lastDay, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("The schedule lookup failed with %s", resp.Status)
-		return nil, fmt.Errorf("failed to get the schedule: %s", resp.Status)
+// hasAllServices returns true if the recollect service names include every
+// configured service from getServiceNames
+func hasAllServices(serviceNames []string) bool {
+	configuredNames := getServiceNames()
+	if len(configuredNames) < 2 {
+		return false
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.New("failed to get the schedule")
+	found := map[string]bool{}
+	for _, name := range serviceNames {
+		found[strings.ToLower(name)] = true
+	}
+	for _, name := range configuredNames {
+		if !found[strings.ToLower(name)] {
+			return false
+		}
 	}
 
-	type flag struct {
-		Name        string
-		ServiceName string `json:"service_name"`
+	return true
+}
+
+// isQuietHours returns true if the time is within the local time range set in
+// the QUIET_HOURS environment variable (e.g. 22:00-07:00). The range may wrap
+// around midnight. This is always false if the environment variable is unset or
+// invalid.
+func isQuietHours(t time.Time) bool {
+	quietHours := os.Getenv("QUIET_HOURS")
+	if quietHours == "" {
+		return false
 	}
-	type event struct {
-		Day   string
-		Flags []flag
+
+	parts := strings.SplitN(quietHours, "-", 2)
+	if len(parts) != 2 {
+		log.Print("The QUIET_HOURS environment variable is not in the format of 15:04-15:04")
+		return false
 	}
-	type eventJSON struct {
-		Events []event
+	start, startErr := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	end, endErr := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if startErr != nil || endErr != nil {
+		log.Print("The QUIET_HOURS environment variable is not in the format of 15:04-15:04")
+		return false
 	}
-	var rvJSON eventJSON
-	err = json.Unmarshal(body, &rvJSON)
-	if err != nil {
-		log.Printf("Failed to unmarshall the schedule lookup response: %v", err)
-		return nil, fmt.Errorf("failed to unmarshall the response: %v", err)
+
+	minutes := t.Hour()*60 + t.Minute()
+	startMinutes := start.Hour()*60 + start.Minute()
+	endMinutes := end.Hour()*60 + end.Minute()
+	if startMinutes > endMinutes {
+		// The quiet hours wrap around midnight
+		return minutes >= startMinutes || minutes < endMinutes
 	}
+	return minutes >= startMinutes && minutes < endMinutes
+}
 
-	var occurrences []serviceOccurrence
-	for _, event := range rvJSON.Events {
-		for _, flag := range event.Flags {
-			if flag.ServiceName == "waste" {
-				occurrence := serviceOccurrence{event.Day, flag.Name}
-				occurrences = append(occurrences, occurrence)
-				break
-			}
-		}
+// getWeekStart returns the start of the day that begins the week of the time.
+// The first day of the week is set with the WEEK_START environment variable,
+// which is "sunday" (the default) or "monday".
+func getWeekStart(t time.Time) time.Time {
+	firstDay := time.Sunday
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("WEEK_START"))) {
+	case "", "sunday":
+	case "monday":
+		firstDay = time.Monday
+	default:
+		log.Print("The WEEK_START environment variable is not sunday or monday, so using sunday")
 	}
 
-	return occurrences, nil
+	daysSinceStart := (int(t.Weekday()) - int(firstDay) + 7) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-daysSinceStart, 0, 0, 0, 0, t.Location())
 }
 
-// main starts AWS Lambda on the intentDispatcher function
-func main() {
-	lambda.Start(intentDispatcher)
+// isEveningMode returns true if the time is at or after the local time set in
+// the EVENING_MODE_AFTER environment variable (e.g. 19:00). This is always false
+// if the environment variable is unset or invalid.
+func isEveningMode(t time.Time) bool {
+	eveningAfter := os.Getenv("EVENING_MODE_AFTER")
+	if eveningAfter == "" {
+		return false
+	}
+
+	eveningStart, err := time.Parse("15:04", eveningAfter)
+	if err != nil {
+		log.Printf("The EVENING_MODE_AFTER environment variable is not in the format of 15:04: %v", err)
+		return false
+	}
+
+	return t.Hour()*60+t.Minute() >= eveningStart.Hour()*60+eveningStart.Minute()
+}
+
+// isUsualPickUp returns true if every service picked up on the day (e.g.
+// 2021-06-22) is on its usual weekday, as inferred from the occurrences
+func isUsualPickUp(occurrences []serviceOccurrence, day string) bool {
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return false
+	}
+
+	serviceDays := map[string][]string{}
+	for _, occurrence := range occurrences {
+		serviceDays[occurrence.name] = append(serviceDays[occurrence.name], occurrence.day)
+	}
+
+	for _, occurrence := range occurrences {
+		if occurrence.day != day || strings.TrimSpace(occurrence.name) == "" {
+			continue
+		}
+
+		weekday, ok := usualWeekday(serviceDays[occurrence.name])
+		if !ok || weekday != t.Weekday() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// usualWeekday returns the weekday that more than half of the days (e.g.
+// 2021-06-22) fall on. The second return value is false if there are fewer than
+// two days or no weekday is the majority.
+func usualWeekday(days []string) (time.Weekday, bool) {
+	if len(days) < 2 {
+		return time.Sunday, false
+	}
+
+	counts := map[time.Weekday]int{}
+	for _, day := range days {
+		t, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			log.Printf("Failed to parse the day %s: %v", day, err)
+			continue
+		}
+		counts[t.Weekday()]++
+	}
+
+	for weekday, count := range counts {
+		if count*2 > len(days) {
+			return weekday, true
+		}
+	}
+
+	return time.Sunday, false
+}
+
+// formatWeekNotices returns the card text listing the notices in the next week.
+// This is empty if there are no notices in the next week.
+func formatWeekNotices(notices []serviceOccurrence) string {
+	weekEnd := localNow().AddDate(0, 0, 7).Format("2006-01-02")
+	var text string
+	for _, notice := range notices {
+		if notice.day >= weekEnd {
+			break
+		}
+		text += fmt.Sprintf("\n%s: %s", notice.GetCardDay(), notice.GetName())
+		if notice.title != "" {
+			text += fmt.Sprintf(" (%s)", notice.title)
+		}
+	}
+
+	if text == "" {
+		return ""
+	}
+	return "\n\nAlso this week:" + text
+}
+
+// handleRoutineSummary handles the RoutineSummary intent and returns a one line
+// answer that ends the session. This is meant to be used in Alexa
+// routines where a welcome message or a reprompt is undesirable.
+func handleRoutineSummary(ctx context.Context, client httpDoer, address string) (scheduleAnswer, error) {
+	occurrences, err := getUpcomingSchedule(ctx, client, address)
+	if err != nil {
+		return scheduleAnswer{}, err
+	}
+
+	pickUpDays := groupByDay(occurrences)
+	if len(pickUpDays) == 0 {
+		msg := fmt.Sprintf("No curbside pick up is scheduled in the next %d days.", getLookaheadDays())
+		return newAnswer("Curbside Pick Up", msg), nil
+	}
+
+	dayPhrase := relativeDayPhrase(pickUpDays[0][0].day)
+	msg := fmt.Sprintf("%s is %s.", capitalize(dayPhrase), joinServices(getSortedServiceNames(pickUpDays[0])))
+	answer := newAnswer("Curbside Pick Up", msg)
+	answer.addOccurrences(pickUpDays[0]...)
+	answer.RelativeDay = dayPhrase
+	return answer, nil
+}
+
+// handleNextTwoDays handles the NextTwoDays intent and returns an answer with
+// the services on the next two curbside pick up days
+func handleNextTwoDays(ctx context.Context, client httpDoer, address string) (scheduleAnswer, error) {
+	occurrences, err := getUpcomingSchedule(ctx, client, address)
+	if err != nil {
+		return scheduleAnswer{}, err
+	}
+
+	pickUpDays := groupByDay(occurrences)
+	if len(pickUpDays) == 0 {
+		msg := fmt.Sprintf("No curbside pick up is scheduled in the next %d days.", getLookaheadDays())
+		return newAnswer("No Curbside Pick Up", msg), nil
+	}
+
+	if len(pickUpDays) > 2 {
+		pickUpDays = pickUpDays[:2]
+	}
+
+	var sentences []string
+	for _, dayOccurrences := range pickUpDays {
+		dayPhrase := relativeDayPhrase(dayOccurrences[0].day)
+		serviceNames := getSortedServiceNames(dayOccurrences)
+		sentences = append(sentences, fmt.Sprintf("%s: %s.", capitalize(dayPhrase), joinServices(serviceNames)))
+	}
+
+	if len(pickUpDays) == 1 {
+		log.Printf("Only one pick up day is scheduled in the next %d days", getLookaheadDays())
+		sentences = append(sentences, fmt.Sprintf("There are no other pick ups in the next %d days.", getLookaheadDays()))
+	}
+
+	answer := newAnswer("Next Curbside Pick Ups", strings.Join(sentences, " "))
+	for _, dayOccurrences := range pickUpDays {
+		answer.addOccurrences(dayOccurrences...)
+	}
+	return answer, nil
+}
+
+// handleListSchedule handles the ListSchedule intent and returns an answer with
+// the next occurrence of every configured service in the look ahead window. The
+// answer is grouped by service or by day based on LIST_GROUPING. At most
+// MAX_SPEECH_DAYS distinct days are spoken, but the card lists them all. A long
+// answer ends with the scheduleRecap.
+func handleListSchedule(ctx context.Context, client httpDoer, address string) (scheduleAnswer, error) {
+	occurrences, err := getUpcomingSchedule(ctx, client, address)
+	if err != nil {
+		return scheduleAnswer{}, err
+	}
+
+	var nextOccurrences []serviceOccurrence
+	var missingServices []string
+	for _, name := range getServiceNames() {
+		serviceName := serviceOccurrence{name: name}.GetName()
+		found := false
+		// occurrences is ordered by date in ascending order
+		for _, occurrence := range occurrences {
+			if occurrence.GetName() == serviceName {
+				found = true
+				nextOccurrences = append(nextOccurrences, occurrence)
+				break
+			}
+		}
+
+		if !found {
+			log.Printf("The service %s has no upcoming occurrence", serviceName)
+			missingServices = append(missingServices, serviceName)
+		}
+	}
+
+	// 0 means that the number of spoken days isn't limited
+	maxSpeechDays := getIntEnv("MAX_SPEECH_DAYS", 0)
+	var phrases, cardLines []string
+	var spokenDays, unspokenDays int
+	if getListGrouping() == "by-day" {
+		phrases, cardLines, spokenDays, unspokenDays = listScheduleByDay(nextOccurrences, maxSpeechDays)
+	} else {
+		phrases, cardLines, spokenDays, unspokenDays = listScheduleByService(nextOccurrences, maxSpeechDays)
+	}
+
+	for _, serviceName := range missingServices {
+		phrases = append(phrases, fmt.Sprintf("there's no %s in the next %d days", strings.ToLower(serviceName), getLookaheadDays()))
+		cardLines = append(cardLines, fmt.Sprintf("%s: none in the next %d days", serviceName, getLookaheadDays()))
+	}
+
+	if unspokenDays > 0 {
+		log.Printf("Speaking %d of the %d pick up days", spokenDays, spokenDays+unspokenDays)
+		morePhrase := fmt.Sprintf("%d more pick up days; see the card", unspokenDays)
+		if unspokenDays == 1 {
+			morePhrase = "1 more pick up day; see the card"
+		}
+		phrases = append(phrases, morePhrase)
+	}
+
+	msg := capitalize(joinServices(phrases)) + "."
+	ssml := ssmlListBreaks(msg)
+	if recap := scheduleRecap(occurrences); recap != "" && len(phrases) >= getIntEnv("RECAP_MIN_PHRASES", 4) {
+		log.Printf("Adding a recap to the %d phrases of the schedule", len(phrases))
+		msg += " " + recap
+		ssml += " " + ssmlListBreaks(recap)
+	}
+
+	answer := newAnswer("Curbside Pick Up Schedule", msg)
+	answer.SSML = ssml
+	answer.CardBody = strings.Join(cardLines, "\n")
+	answer.addOccurrences(nextOccurrences...)
+	return answer, nil
+}
+
+// scheduleRecap returns a one line summary of how often each configured service
+// is picked up in the occurrences (e.g. "In short, garbage is weekly on Mondays
+// and recycling is every two weeks on Mondays."). The services without a regular
+// cadence are left out, and this is empty if none have one.
+func scheduleRecap(occurrences []serviceOccurrence) string {
+	var phrases []string
+	for _, name := range getServiceNames() {
+		serviceName := serviceOccurrence{name: name}.GetName()
+		var days []string
+		for _, occurrence := range occurrences {
+			if occurrence.GetName() == serviceName {
+				days = append(days, occurrence.day)
+			}
+		}
+
+		interval := serviceCadence(days)
+		if interval == 0 {
+			continue
+		}
+
+		phrase := fmt.Sprintf("%s is %s", strings.ToLower(serviceName), cadencePhrase(interval))
+		if weekday, ok := usualWeekday(days); ok && interval%7 == 0 {
+			phrase += fmt.Sprintf(" on %ss", weekday)
+		}
+		phrases = append(phrases, phrase)
+	}
+
+	if len(phrases) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("In short, %s.", joinServices(phrases))
+}
+
+// listScheduleByService returns the ListSchedule phrases and card lines with a
+// phrase per service in the configured order (e.g. "next garbage is Monday June
+// 21") and the number of spoken and unspoken days. Once maxSpeechDays distinct
+// days are spoken, the services on other days are only on the card.
+func listScheduleByService(nextOccurrences []serviceOccurrence, maxSpeechDays int) ([]string, []string, int, int) {
+	spokenDays := map[string]bool{}
+	unspokenDays := map[string]bool{}
+	var phrases []string
+	var cardLines []string
+	for _, occurrence := range nextOccurrences {
+		serviceName := occurrence.GetName()
+		cardLines = append(cardLines, fmt.Sprintf("%s: %s", serviceName, occurrence.GetCardDay()))
+		if maxSpeechDays > 0 && !spokenDays[occurrence.day] && len(spokenDays) >= maxSpeechDays {
+			unspokenDays[occurrence.day] = true
+			continue
+		}
+		spokenDays[occurrence.day] = true
+		phrases = append(phrases, fmt.Sprintf("next %s is %s", strings.ToLower(serviceName), occurrence.GetListDay()))
+	}
+
+	return phrases, cardLines, len(spokenDays), len(unspokenDays)
+}
+
+// listScheduleByDay returns the ListSchedule phrases and card lines with a
+// phrase per day in chronological order (e.g. "Monday June 21 is garbage and
+// recycling") and the number of spoken and unspoken days. Only the first
+// maxSpeechDays days are spoken, but the card lists them all.
+func listScheduleByDay(nextOccurrences []serviceOccurrence, maxSpeechDays int) ([]string, []string, int, int) {
+	sortedOccurrences := append([]serviceOccurrence{}, nextOccurrences...)
+	sortOccurrences(sortedOccurrences)
+
+	var phrases []string
+	var cardLines []string
+	days := groupByDay(sortedOccurrences)
+	for i, dayOccurrences := range days {
+		serviceNames := joinServices(getSortedServiceNames(dayOccurrences))
+		cardLines = append(cardLines, fmt.Sprintf("%s: %s", dayOccurrences[0].GetCardDay(), serviceNames))
+		if maxSpeechDays > 0 && i >= maxSpeechDays {
+			continue
+		}
+		phrases = append(phrases, fmt.Sprintf("%s is %s", dayOccurrences[0].GetListDay(), serviceNames))
+	}
+
+	spokenDays := len(days)
+	if maxSpeechDays > 0 && spokenDays > maxSpeechDays {
+		spokenDays = maxSpeechDays
+	}
+	return phrases, cardLines, spokenDays, len(days) - spokenDays
+}
+
+// getListGrouping returns how the ListSchedule answer is grouped. This is set
+// with the LIST_GROUPING environment variable, which is "by-service" (the
+// default) for a phrase per service or "by-day" for a phrase per pick up day.
+func getListGrouping() string {
+	switch grouping := strings.ToLower(strings.TrimSpace(os.Getenv("LIST_GROUPING"))); grouping {
+	case "", "by-service":
+		return "by-service"
+	case "by-day":
+		return grouping
+	default:
+		log.Printf("The LIST_GROUPING environment variable of %s is not by-day or by-service, so using by-service", grouping)
+		return "by-service"
+	}
+}
+
+// handleWeekAhead handles the WeekAhead intent and returns an answer with the
+// services on each of the next seven days. The card has a row per day. On
+// devices with a display, the speech is short since the card is shown.
+func handleWeekAhead(ctx context.Context, client httpDoer, address string, hasDisplay bool) (scheduleAnswer, error) {
+	occurrences, err := getUpcomingSchedule(ctx, client, address)
+	if err != nil {
+		return scheduleAnswer{}, err
+	}
+
+	dayServices := map[string][]serviceOccurrence{}
+	for _, dayOccurrences := range groupByDay(occurrences) {
+		dayServices[dayOccurrences[0].day] = dayOccurrences
+	}
+
+	var answerOccurrences []serviceOccurrence
+	var sentences []string
+	var cardLines []string
+	today := localNow()
+	for i := 0; i < 7; i++ {
+		day := today.AddDate(0, 0, i).Format("2006-01-02")
+		// The rows are always compact so that they line up like a grid
+		cardDay := serviceOccurrence{day: day}.formatDay("compact")
+		dayOccurrences, ok := dayServices[day]
+		if !ok {
+			cardLines = append(cardLines, fmt.Sprintf("%s: -", cardDay))
+			continue
+		}
+
+		answerOccurrences = append(answerOccurrences, dayOccurrences...)
+		serviceNames := joinServices(getSortedServiceNames(dayOccurrences))
+		cardLines = append(cardLines, fmt.Sprintf("%s: %s", cardDay, serviceNames))
+		sentences = append(sentences, fmt.Sprintf("%s: %s.", capitalize(relativeDayPhrase(day)), serviceNames))
+	}
+
+	title := "Week Ahead Curbside Pick Up"
+	if len(answerOccurrences) == 0 {
+		return newAnswer(title, "No curbside pick up is scheduled in the next week."), nil
+	}
+
+	msg := strings.Join(sentences, " ")
+	if hasDisplay {
+		log.Print("Showing the week ahead on the display")
+		msg = fmt.Sprintf("Here's your week ahead with %s.", pickUpDaysPhrase(len(sentences)))
+	}
+
+	answer := newAnswer(title, msg)
+	answer.CardBody = strings.Join(cardLines, "\n")
+	answer.addOccurrences(answerOccurrences...)
+	return answer, nil
+}
+
+// handleIsPickupOn handles the IsPickupOn intent and returns an answer with
+// whether there's a curbside pick up on the day (e.g. 2021-06-25) from the
+// AMAZON.DATE slot and which services are picked up. Only the days in the look
+// ahead window can be answered.
+func handleIsPickupOn(ctx context.Context, client httpDoer, address string, day string) (scheduleAnswer, error) {
+	title := "Curbside Pick Up"
+	// The AMAZON.DATE slot can also resolve to a week, month, or season
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		log.Printf("The date %s is not a specific day", day)
+		return newAnswer(title, "Please ask about a specific day, like is there pick up on Friday."), nil
+	}
+
+	days := daysUntil(t)
+	if days < 0 {
+		log.Printf("The date %s is in the past", day)
+		return newAnswer(title, "That day has already passed. I can only tell you about upcoming pick ups."), nil
+	}
+	if days > getLookaheadDays() {
+		log.Printf("The date %s is outside of the look ahead window", day)
+		msg := fmt.Sprintf("I only know the schedule for the next %d days.", getLookaheadDays())
+		return newAnswer(title, msg), nil
+	}
+
+	occurrences, err := getUpcomingSchedule(ctx, client, address)
+	if err != nil {
+		return scheduleAnswer{}, err
+	}
+
+	var dayOccurrences []serviceOccurrence
+	for _, occurrence := range occurrences {
+		if occurrence.day == day && strings.TrimSpace(occurrence.name) != "" {
+			dayOccurrences = append(dayOccurrences, occurrence)
+		}
+	}
+
+	dayOccurrence := serviceOccurrence{day: day}
+	var msg string
+	if len(dayOccurrences) == 0 {
+		msg = fmt.Sprintf("No, there's no curbside pick up %s.", dayOccurrence.GetSpokenDay())
+	} else {
+		serviceNames := joinServices(getSortedServiceNames(dayOccurrences))
+		msg = fmt.Sprintf("Yes, there's %s %s.", serviceNames, dayOccurrence.GetSpokenDay())
+	}
+
+	answer := newAnswer(title, msg)
+	answer.SSML = dayOccurrence.ssmlWithDay(msg)
+	answer.RelativeDay = relativeDayPhrase(day)
+	answer.addOccurrences(dayOccurrences...)
+	return answer, nil
+}
+
+// pickUpDaysPhrase returns how the number of pick up days should be spoken (e.g.
+// "2 pick up days")
+func pickUpDaysPhrase(count int) string {
+	if count == 1 {
+		return "1 pick up day"
+	}
+	return fmt.Sprintf("%d pick up days", count)
+}
+
+// groupByDay returns the occurrences grouped by day in ascending order. The
+// occurrences without a service name are skipped since it's bad data.
+func groupByDay(occurrences []serviceOccurrence) [][]serviceOccurrence {
+	var days [][]serviceOccurrence
+	// occurrences is ordered by date in ascending order
+	for _, occurrence := range occurrences {
+		if strings.TrimSpace(occurrence.name) == "" {
+			continue
+		}
+
+		if len(days) == 0 || days[len(days)-1][0].day != occurrence.day {
+			days = append(days, nil)
+		}
+		days[len(days)-1] = append(days[len(days)-1], occurrence)
+	}
+
+	return days
+}
+
+// getSortedServiceNames returns the lower case friendly service names of the
+// occurrences in alphabetical order
+func getSortedServiceNames(occurrences []serviceOccurrence) []string {
+	serviceNames := make([]string, 0, len(occurrences))
+	for _, occurrence := range occurrences {
+		serviceNames = append(serviceNames, strings.ToLower(occurrence.GetName()))
+	}
+	sort.Strings(serviceNames)
+	return serviceNames
+}
+
+// handleNextMonth handles the NextMonth intent and returns an answer with the
+// curbside pick up services in the next calendar month. The speech is
+// grouped by service and the card is grouped by day.
+func handleNextMonth(ctx context.Context, client httpDoer, address string) (scheduleAnswer, error) {
+	now := localNow()
+	monthStart := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+	allOccurrences, err := scheduleBetween(ctx, client, address, monthStart, monthStart.AddDate(0, 1, 0))
+	if err != nil {
+		return scheduleAnswer{}, err
+	}
+
+	// Don't rely on recollect's handling of the window boundaries
+	month := monthStart.Format("2006-01")
+	var occurrences []serviceOccurrence
+	for _, occurrence := range allOccurrences {
+		if strings.HasPrefix(occurrence.day, month) && strings.TrimSpace(occurrence.name) != "" {
+			occurrences = append(occurrences, occurrence)
+		}
+	}
+
+	monthName := monthStart.Format("January")
+	title := fmt.Sprintf("%s Curbside Pick Up", monthName)
+	if len(occurrences) == 0 {
+		msg := fmt.Sprintf("No curbside pick up is scheduled in %s.", monthName)
+		return newAnswer(title, msg), nil
+	}
+
+	var days []string
+	dayServices := map[string][]string{}
+	var serviceNames []string
+	serviceDays := map[string][]string{}
+	for _, occurrence := range occurrences {
+		name := strings.ToLower(occurrence.GetName())
+		day := occurrence.GetCardDay()
+		if _, ok := dayServices[day]; !ok {
+			days = append(days, day)
+		}
+		dayServices[day] = append(dayServices[day], name)
+		if _, ok := serviceDays[name]; !ok {
+			serviceNames = append(serviceNames, name)
+		}
+		serviceDays[name] = append(serviceDays[name], occurrence.day)
+	}
+	sort.Strings(serviceNames)
+
+	log.Printf("Found %d pick up days in %s", len(days), monthName)
+	msg := fmt.Sprintf("In %s, there will be curbside pick up on %d days.", monthName, len(days))
+	for _, name := range serviceNames {
+		dayPhrases := collapseDayRanges(serviceDays[name])
+		if len(dayPhrases) == 1 && len(serviceDays[name]) > 1 {
+			msg += fmt.Sprintf(" %s runs %s.", capitalize(name), dayPhrases[0])
+		} else {
+			msg += fmt.Sprintf(" %s is picked up %s: on %s.", capitalize(name), timesPhrase(len(serviceDays[name])), joinServices(dayPhrases))
+		}
+	}
+
+	var cardLines []string
+	for _, day := range days {
+		sort.Strings(dayServices[day])
+		cardLines = append(cardLines, fmt.Sprintf("%s: %s", day, joinServices(dayServices[day])))
+	}
+
+	answer := newAnswer(title, msg)
+	answer.CardBody = strings.Join(cardLines, "\n")
+	answer.addOccurrences(occurrences...)
+	return answer, nil
+}
+
+// collapseDayRanges returns the days (e.g. 2021-06-21) in ascending order in the
+// format of January 2, where three or more consecutive days are collapsed into
+// a range (e.g. June 21 through June 23)
+func collapseDayRanges(days []string) []string {
+	var phrases []string
+	for i := 0; i < len(days); {
+		t, err := time.Parse("2006-01-02", days[i])
+		if err != nil {
+			log.Printf("Failed to parse the day %s: %v", days[i], err)
+			phrases = append(phrases, unknownDayPhrase)
+			i++
+			continue
+		}
+
+		// Find the last day of the run of consecutive days starting at i
+		runEnd := i
+		for runEnd+1 < len(days) && days[runEnd+1] == t.AddDate(0, 0, runEnd+1-i).Format("2006-01-02") {
+			runEnd++
+		}
+
+		if runEnd-i >= 2 {
+			endTime := t.AddDate(0, 0, runEnd-i)
+			phrases = append(phrases, fmt.Sprintf("%s through %s", t.Format("January 2"), endTime.Format("January 2")))
+			i = runEnd + 1
+		} else {
+			phrases = append(phrases, t.Format("January 2"))
+			i++
+		}
+	}
+
+	return phrases
+}
+
+// timesPhrase returns how the count should be spoken as a number of times (e.g.
+// "once", "twice", or "3 times")
+func timesPhrase(count int) string {
+	switch count {
+	case 1:
+		return "once"
+	case 2:
+		return "twice"
+	default:
+		return fmt.Sprintf("%d times", count)
+	}
+}
+
+// relativeDayPhrase returns how the day (e.g. 2021-06-22) should be phrased
+// relative to today. This will be "today", "tomorrow", the weekday if it's within
+// the next week, or the date otherwise. If the PHRASING_STYLE environment
+// variable is "next-weekday", a day in the following week is phrased as "next"
+// and the weekday (e.g. "next Monday") instead of the date.
+func relativeDayPhrase(day string) string {
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		log.Printf("Failed to parse the day %s: %v", day, err)
+		return unknownDayPhrase
+	}
+
+	days := daysUntil(t)
+	if (days == 0 || days == 1) && isTodayAmbiguous(localNow()) {
+		log.Print("Phrasing the day with its date since it's near midnight and the time zone isn't configured")
+		return t.Format("Monday, January 2")
+	}
+
+	switch {
+	case days == 0:
+		return "today"
+	case days == 1:
+		return "tomorrow"
+	case days > 1 && days < 7:
+		return t.Format("Monday")
+	case days >= 7 && days <= 13 && strings.ToLower(os.Getenv("PHRASING_STYLE")) == "next-weekday":
+		return "next " + t.Format("Monday")
+	default:
+		return t.Format("Monday, January 2")
+	}
+}
+
+// daysUntil returns the number of calendar days from today until the date. This
+// is based on the dates rather than 24 hour periods, so a date later today is 0
+// days away.
+func daysUntil(t time.Time) int {
+	now := localNow()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return int(date.Sub(today).Hours() / 24)
+}
+
+// daysUntilPhrase returns how long until the day (e.g. 2021-06-22) is, which is
+// "today", "tomorrow", or "in" and the number of days (e.g. "in 2 days") if
+// it's within the next week. This is empty otherwise.
+func daysUntilPhrase(day string) string {
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return ""
+	}
+
+	days := daysUntil(t)
+	if days < 7 && isTodayAmbiguous(localNow()) {
+		return ""
+	}
+
+	switch {
+	case days == 0:
+		return "today"
+	case days == 1:
+		return "tomorrow"
+	case days > 1 && days < 7:
+		return fmt.Sprintf("in %d days", days)
+	default:
+		return ""
+	}
+}
+
+// isTodayAmbiguous returns true if the time is within an hour of midnight and
+// the TIME_ZONE environment variable isn't explicitly set to a time zone other
+// than UTC. In that case, which day is today may be wrong, so the relative days
+// (e.g. today) should be phrased with the date instead.
+func isTodayAmbiguous(t time.Time) bool {
+	timeZone := strings.TrimSpace(os.Getenv("TIME_ZONE"))
+	if timeZone != "" && timeZone != "UTC" {
+		return false
+	}
+
+	minutes := t.Hour()*60 + t.Minute()
+	return minutes < 60 || minutes >= 23*60
+}
+
+// capitalize returns the text with its first letter in upper case
+func capitalize(text string) string {
+	if text == "" {
+		return text
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+// joinServicesWithOr joins the service names in a list that can be spoken as
+// a question (e.g. "yard waste or yard waste bulk")
+func joinServicesWithOr(serviceNames []string) string {
+	switch len(serviceNames) {
+	case 0, 1:
+		return joinServices(serviceNames)
+	case 2:
+		return fmt.Sprintf("%s or %s", serviceNames[0], serviceNames[1])
+	default:
+		last := len(serviceNames) - 1
+		return fmt.Sprintf("%s, or %s", strings.Join(serviceNames[:last], ", "), serviceNames[last])
+	}
+}
+
+// joinServices joins the service names in a list that can be spoken (e.g.
+// "garbage, recycling, and yard waste")
+func joinServices(serviceNames []string) string {
+	switch len(serviceNames) {
+	case 0:
+		return ""
+	case 1:
+		return serviceNames[0]
+	case 2:
+		return fmt.Sprintf("%s and %s", serviceNames[0], serviceNames[1])
+	default:
+		last := len(serviceNames) - 1
+		return fmt.Sprintf("%s, and %s", strings.Join(serviceNames[:last], ", "), serviceNames[last])
+	}
+}
+
+// errNotConfigured is returned when the skill is missing required configuration
+var errNotConfigured = errors.New("the skill is not configured correctly")
+
+// intentDispatcher handles all incoming Alexa requests and returns an Alexa
+// response. This is a consentResponse if the address permission is needed. A
+// panic is recovered from so that a bad request never crashes the Lambda.
+func intentDispatcher(ctx context.Context, client httpDoer, request skillRequest) (response interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from a panic handling the intent %s: %v\n%s", request.Body.Intent.Name, r, debug.Stack())
+			answer := newErrorAnswer("Curbside Pick Up Unavailable", fmt.Errorf("panic: %v", r))
+			response = answer.toAlexaResponse()
+			err = nil
+		}
+	}()
+
+	if ctx == nil {
+		// Alternate invokers may not provide a context
+		ctx = context.Background()
+	}
+	answer, err := dispatchIntent(ctx, client, request)
+	if errors.Is(err, errAddressPermission) {
+		return newAddressConsentResponse(), nil
+	}
+	if err != nil {
+		// Use the configured fallback message when recollect can't be reached at all
+		var urlErr *url.Error
+		fallbackMsg := os.Getenv("FALLBACK_MESSAGE")
+		if errors.Is(err, errNotConfigured) {
+			log.Printf("Error: the skill is not configured correctly: %v", err)
+			answer = newAnswer("Curbside Pick Up Unavailable", "Sorry, the skill is not configured correctly.")
+		} else if fallbackMsg != "" && errors.As(err, &urlErr) {
+			log.Printf("Responding with the fallback message since recollect is unreachable: %v", err)
+			answer = newAnswer("Curbside Pick Up Unavailable", fallbackMsg)
+		} else {
+			answer = newErrorAnswer("Curbside Pick Up Unavailable", err)
+		}
+	}
+
+	if isQuietHours(localNow()) && answer.Reprompt != "" {
+		log.Print("Ending the session without the reprompt during quiet hours")
+		answer.Reprompt = ""
+		answer.PendingIntent = ""
+	}
+
+	return addSpeechPrefix(answer.toAlexaResponse(), os.Getenv("SPEECH_PREFIX")), nil
+}
+
+// newErrorAnswer returns an answer apologizing that the schedule couldn't be
+// retrieved so that the user doesn't hear a generic skill failure. The error is
+// logged for debugging.
+func newErrorAnswer(title string, err error) scheduleAnswer {
+	log.Printf("Responding with an error message: %v", err)
+	const msg = "Sorry, I couldn't reach the Cary pick up service right now. Please try again in a moment."
+	return newAnswer(title, msg)
+}
+
+// addSpeechPrefix returns a copy of the response with the prefix (e.g. "Cary
+// Curbside says:") added to the start of the spoken output. The response is
+// returned as is if the prefix is empty.
+func addSpeechPrefix(response alexa.Response, prefix string) alexa.Response {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" || response.Body.OutputSpeech == nil {
+		return response
+	}
+
+	// Copy the output speech so that the card is never affected
+	speech := *response.Body.OutputSpeech
+	if speech.Type == "SSML" {
+		speech.SSML = strings.Replace(speech.SSML, "<speak>", "<speak>"+html.EscapeString(prefix)+" ", 1)
+	} else {
+		speech.Text = prefix + " " + speech.Text
+	}
+	response.Body.OutputSpeech = &speech
+
+	return response
+}
+
+// dispatchIntent calls the handler of the Alexa request's intent and returns
+// its answer
+func dispatchIntent(ctx context.Context, client httpDoer, request skillRequest) (scheduleAnswer, error) {
+	// Opening the skill without a question sends a LaunchRequest without an intent
+	if request.Body.Type == "LaunchRequest" {
+		log.Print("Welcoming the user to the skill")
+		answer := newAnswer("Cary Curbside Pick Up", "Welcome to Cary curbside pick up. "+getHelpMsg())
+		answer.Reprompt = examplesMsg
+		return answer, nil
+	}
+
+	intentName := normalizeIntentName(request.Body.Intent.Name)
+	// When the user answers a clarification question with just the collection
+	// type, it's handled by the intent that asked the question. Session
+	// attributes are only trusted in a continuing session.
+	if pendingIntent, ok := request.Session.Attributes["pendingIntent"].(string); ok && !request.Session.New {
+		if intentName == "GetSchedule" && (pendingIntent == "Frequency" || pendingIntent == "ServiceWeekday" || pendingIntent == "SeasonInfo" || pendingIntent == "MissedPickup") {
+			log.Printf("Handling the answer to the clarification question with the %s intent", pendingIntent)
+			intentName = pendingIntent
+		}
+	}
+	log.Printf("Finding the handler for the intent %s", intentName)
+	// The built-in intents don't need the address, which may require an HTTP
+	// request or the user's permission
+	if answer, ok := handleBuiltInIntent(intentName); ok {
+		return answer, nil
+	}
+
+	// Reject unknown intents before looking up the address, which may require an
+	// HTTP request
+	if !isKnownIntent(intentName) {
+		log.Printf("The intent %s was unrecognized", intentName)
+		return newAnswer("Unknown Request", "The intent was unrecognized"), nil
+	}
+
+	if !isIntentEnabled(intentName) {
+		log.Printf("The intent %s is disabled", intentName)
+		return newAnswer("Curbside Pick Up", "That feature isn't enabled for this skill."), nil
+	}
+
+	switch intentName {
+	case "GetSchedule", "Frequency", "ServiceWeekday", "SeasonInfo", "MissedPickup":
+		// Alexa sometimes fills the collectionType slot with a spoken date
+		if serviceType := getServiceType(request.Body.Intent); isDateLike(serviceType) {
+			log.Printf("The %s intent has the date-like service type %s", intentName, serviceType)
+			var serviceNames []string
+			for _, name := range getServiceNames() {
+				serviceNames = append(serviceNames, serviceOccurrence{name: name}.GetName())
+			}
+			return newClarificationAnswer(intentName, serviceNames), nil
+		}
+	}
+
+	address, err := getAddress(ctx, client, request)
+	if err != nil {
+		return scheduleAnswer{}, err
+	}
+
+	// During quiet hours, the general schedule intents get the one line summary
+	if isQuietHours(localNow()) {
+		switch intentName {
+		case "WhatIsNext", "NextTwoDays", "NextMonth":
+			log.Printf("Handling the %s intent with the RoutineSummary intent during quiet hours", intentName)
+			intentName = "RoutineSummary"
+		}
+	}
+
+	answer, err := handleScheduleIntent(ctx, client, request, intentName, address)
+	if err == nil && getBoolEnv("ATTRIBUTION") {
+		answer.addAttribution()
+	}
+	return answer, err
+}
+
+// handleScheduleIntent calls the handler of the intent that needs the curbside
+// pick up schedule of the address and returns its answer
+func handleScheduleIntent(ctx context.Context, client httpDoer, request skillRequest, intentName string, address string) (scheduleAnswer, error) {
+	switch intentName {
+	case "GetSchedule":
+		serviceType := getServiceType(request.Body.Intent)
+		log.Printf("The GetSchedule intent has the service type %s", serviceType)
+		return handleGetSchedule(ctx, client, address, serviceType)
+	case "Frequency":
+		serviceType := getServiceType(request.Body.Intent)
+		log.Printf("The Frequency intent has the service type %s", serviceType)
+		return handleFrequency(ctx, client, address, serviceType)
+	case "ServiceWeekday":
+		serviceType := getServiceType(request.Body.Intent)
+		log.Printf("The ServiceWeekday intent has the service type %s", serviceType)
+		return handleServiceWeekday(ctx, client, address, serviceType)
+	case "WhatIsNext":
+		return handleWhatIsNext(ctx, client, address)
+	case "RoutineSummary":
+		return handleRoutineSummary(ctx, client, address)
+	case "NextMonth":
+		return handleNextMonth(ctx, client, address)
+	case "NextTwoDays":
+		return handleNextTwoDays(ctx, client, address)
+	case "ListSchedule":
+		return handleListSchedule(ctx, client, address)
+	case "WeekAhead":
+		return handleWeekAhead(ctx, client, address, request.DeviceContext.hasDisplay())
+	case "SeasonInfo":
+		serviceType := getServiceType(request.Body.Intent)
+		log.Printf("The SeasonInfo intent has the service type %s", serviceType)
+		return handleSeasonInfo(ctx, client, address, serviceType)
+	case "DebugInfo":
+		return handleDebugInfo(ctx, client, address)
+	case "MissedPickup":
+		serviceType := getServiceType(request.Body.Intent)
+		log.Printf("The MissedPickup intent has the service type %s", serviceType)
+		return handleMissedPickup(ctx, client, address, serviceType)
+	case "IsPickupOn":
+		day := strings.TrimSpace(request.Body.Intent.Slots["date"].Value)
+		log.Printf("The IsPickupOn intent has the date %s", day)
+		return handleIsPickupOn(ctx, client, address, day)
+	default:
+		log.Printf("The intent %s was unrecognized", intentName)
+		answer := newAnswer("Unknown Request", "The intent was unrecognized")
+		return answer, nil
+	}
+}
+
+// examplesMsg gives examples of the supported queries
+const examplesMsg string = `You can say things like what's next or when's recycling.`
+
+// getHelpMsg returns the description of the supported queries with the
+// collection types from getServiceNames
+func getHelpMsg() string {
+	return fmt.Sprintf("%s The supported collection types are: %s.", examplesMsg, joinServices(getSpokenServiceNames()))
+}
+
+// handleBuiltInIntent returns the answer to the Amazon built-in intents that
+// don't need the curbside pick up schedule. The second return value is false if
+// the intent isn't one of them.
+func handleBuiltInIntent(intentName string) (scheduleAnswer, bool) {
+	switch intentName {
+	case "AMAZON.HelpIntent":
+		answer := newAnswer("Help", getHelpMsg())
+		return answer, true
+	case "AMAZON.FallbackIntent":
+		log.Print("The utterance didn't match any of the intents")
+		fallbackMsg := "Sorry, I didn't get that. " + getHelpMsg()
+		answer := newAnswer("Curbside Pick Up", fallbackMsg)
+		answer.Reprompt = examplesMsg
+		return answer, true
+	case "AMAZON.StopIntent", "AMAZON.CancelIntent":
+		goodbyeMsg := os.Getenv("GOODBYE_MESSAGE")
+		if goodbyeMsg == "" {
+			goodbyeMsg = "Goodbye."
+		}
+		// The answer has no reprompt, so the session is ended
+		return newAnswer("Goodbye", goodbyeMsg), true
+	case "AMAZON.YesIntent", "AMAZON.NoIntent", "AMAZON.RepeatIntent", "AMAZON.MoreIntent", "AMAZON.NextIntent":
+		// None of these are expected since the skill never asks a yes or no
+		// question or offers more results
+		log.Printf("The intent %s was received without a pending question", intentName)
+		const orphanedMsg string = `I'm not sure what you're responding to. You can ` +
+			`say things like what's next or when's recycling.`
+		answer := newAnswer("Curbside Pick Up", orphanedMsg)
+		answer.Reprompt = orphanedMsg
+		return answer, true
+	default:
+		return scheduleAnswer{}, false
+	}
+}
+
+// intentNames are the intent names handled by dispatchIntent. This must be kept
+// in sync with the cases in dispatchIntent and handleBuiltInIntent.
+var intentNames = []string{
+	"GetSchedule", "Frequency", "ServiceWeekday", "WhatIsNext", "RoutineSummary", "NextMonth", "NextTwoDays", "ListSchedule", "WeekAhead", "SeasonInfo", "DebugInfo", "IsPickupOn", "MissedPickup",
+	"AMAZON.HelpIntent", "AMAZON.FallbackIntent", "AMAZON.StopIntent", "AMAZON.CancelIntent", "AMAZON.YesIntent", "AMAZON.NoIntent", "AMAZON.RepeatIntent", "AMAZON.MoreIntent", "AMAZON.NextIntent",
+}
+
+// isKnownIntent returns true if the intent name is in intentNames
+func isKnownIntent(intentName string) bool {
+	for _, name := range intentNames {
+		if name == intentName {
+			return true
+		}
+	}
+	return false
+}
+
+// isIntentEnabled returns true if the intent isn't disabled in the comma
+// separated INTENT_FLAGS environment variable in the format of
+// "DebugInfo=false,SeasonInfo=true". All intents are enabled by default.
+func isIntentEnabled(intentName string) bool {
+	for _, intentFlag := range getListEnv("INTENT_FLAGS", nil) {
+		parts := strings.SplitN(intentFlag, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("The intent flag %s is not in the format of name=true", intentFlag)
+			continue
+		}
+
+		if normalizeIntentName(parts[0]) != intentName {
+			continue
+		}
+
+		enabled, err := strconv.ParseBool(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Printf("The intent flag %s has an invalid boolean value", intentFlag)
+			continue
+		}
+		return enabled
+	}
+
+	return true
+}
+
+// normalizeIntentName returns the intent name as it's handled by dispatchIntent.
+// The intent name is matched case insensitively and a leading namespace (e.g.
+// Cary.GetSchedule) is ignored, except for the AMAZON built-in intents. The
+// intent name is returned as is if it's unrecognized.
+func normalizeIntentName(name string) string {
+	name = strings.TrimSpace(name)
+	for _, intentName := range intentNames {
+		if strings.EqualFold(name, intentName) {
+			return intentName
+		}
+	}
+
+	if i := strings.LastIndex(name, "."); i != -1 && !strings.HasPrefix(strings.ToUpper(name), "AMAZON.") {
+		for _, intentName := range intentNames {
+			if strings.EqualFold(name[i+1:], intentName) {
+				return intentName
+			}
+		}
+	}
+
+	return name
+}
+
+// getBoolEnv returns the boolean value of the environment variable. This is
+// false if the environment variable is unset or invalid.
+func getBoolEnv(name string) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("The %s environment variable has an invalid boolean value of %s", name, value)
+		return false
+	}
+	return enabled
+}
+
+// getServiceType returns the service type requested in the intent's
+// collectionType slot
+func getServiceType(intent alexa.Intent) string {
+	slot := intent.Slots["collectionType"]
+	if serviceName, ok := getSlotServiceName(slot); ok {
+		return serviceName
+	}
+	return normalizeServiceType(slot.Value)
+}
+
+// dateLikeRegex matches the values of the AMAZON.DATE slot type (e.g.
+// 2021-06-24, 2021-W25, or XXXX-06-24) and numeric dates (e.g. 6/24)
+var dateLikeRegex = regexp.MustCompile(`^((\d{4}|XXXX)-(\d{2}|W\d{2})(-\d{2}|-WE)?|\d{1,2}/\d{1,2}(/\d{2,4})?|\d+)$`)
+
+// isDateLike returns true if the service type is shaped like a date rather than
+// a collection type
+func isDateLike(serviceType string) bool {
+	return dateLikeRegex.MatchString(strings.TrimSpace(serviceType))
+}
+
+// normalizeServiceType returns the spoken service type without leading articles
+// and possessives (e.g. "the garbage" becomes "garbage"). Common spoken variants
+// are replaced with the friendly service name from serviceTypeAliases.
+func normalizeServiceType(serviceType string) string {
+	words := strings.Fields(serviceType)
+	for len(words) > 1 {
+		switch strings.ToLower(words[0]) {
+		case "the", "my", "our", "a", "an":
+			words = words[1:]
+			continue
+		}
+		break
+	}
+
+	normalized := strings.Join(words, " ")
+	if alias, ok := serviceTypeAliases[strings.ToLower(normalized)]; ok {
+		log.Printf("Using the service type %s for %s", alias, normalized)
+		return alias
+	}
+	return normalized
+}
+
+// serviceTypeAliases maps common spoken variants of the service types to the
+// friendly service names
+var serviceTypeAliases = map[string]string{
+	"trash":                 "Garbage",
+	"trash collection":      "Garbage",
+	"garbage collection":    "Garbage",
+	"recyclables":           "Recycling",
+	"recycling collection":  "Recycling",
+	"yardwaste":             "Yard Waste",
+	"yard waste collection": "Yard Waste",
+	"leaves":                "Leaf Collection",
+	"loose leaves":          "Leaf Collection",
+	"leaf pick up":          "Leaf Collection",
+}
+
+// getSlotServiceName returns the recollect service name mapped to the slot's
+// resolved value ID. The mapping is configured with the SLOT_ID_SERVICES
+// environment variable in the format of "GARBAGE=Garbage,LEAVES=looseleaf". The
+// second return value is false if the slot doesn't have a mapped value ID.
+func getSlotServiceName(slot alexa.Slot) (string, bool) {
+	slotIDServices := map[string]string{}
+	for _, mapping := range strings.Split(os.Getenv("SLOT_ID_SERVICES"), ",") {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			continue
+		}
+		slotIDServices[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	for _, authority := range slot.Resolutions.ResolutionPerAuthority {
+		for _, value := range authority.Values {
+			if serviceName, ok := slotIDServices[value.Value.Id]; ok {
+				log.Printf("The slot value ID %s maps to the service %s", value.Value.Id, serviceName)
+				return serviceName, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// getStreetLine returns the street line of the address by removing a trailing
+// city, state, and zip code (e.g. "1260 NW Maynard Rd, Cary, NC 27513" becomes
+// "1260 NW Maynard Rd"), since the recollect address suggestions expect just the
+// street line. The city is set with the ADDRESS_CITY environment variable and
+// defaults to Cary.
+func getStreetLine(address string) string {
+	city := os.Getenv("ADDRESS_CITY")
+	if city == "" {
+		city = "Cary"
+	}
+
+	cityRegex := regexp.MustCompile(`(?i),\s*` + regexp.QuoteMeta(city) + `\b.*$`)
+	streetLine := strings.TrimSpace(cityRegex.ReplaceAllString(address, ""))
+	if streetLine == "" {
+		return address
+	}
+	if streetLine != address {
+		log.Print("Removed the city, state, and zip code from the address")
+	}
+	return streetLine
+}
+
+// isCacheEnabled returns true if the looked up data should be cached. This is set
+// with the CACHE_BACKEND environment variable, which is "memory" (the default) to
+// cache in the memory of the warm Lambda container or "none" to always look up
+// the data (e.g. to debug stale data).
+func isCacheEnabled() bool {
+	switch backend := strings.ToLower(strings.TrimSpace(os.Getenv("CACHE_BACKEND"))); backend {
+	case "", "memory":
+		return true
+	case "none":
+		return false
+	default:
+		log.Printf("The CACHE_BACKEND environment variable of %s is not none or memory, so using memory", backend)
+		return true
+	}
+}
+
+// addressIDCacheTTL is how long a looked up address ID is reused
+const addressIDCacheTTL = 24 * time.Hour
+
+// getNotFoundCacheTTL returns how long an address that recollect doesn't know is
+// remembered so that repeated requests fail fast. This is set with the
+// NOT_FOUND_CACHE_TTL environment variable and defaults to 5 minutes.
+func getNotFoundCacheTTL() time.Duration {
+	ttl := 5 * time.Minute
+	if value := os.Getenv("NOT_FOUND_CACHE_TTL"); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+			ttl = duration
+		} else {
+			log.Printf("The NOT_FOUND_CACHE_TTL environment variable is not a non-negative duration, so using %v", ttl)
+		}
+	}
+	return ttl
+}
+
+// addressIDCache caches the looked up address IDs across warm Lambda invocations
+// since an address ID essentially never changes
+var addressIDCache = struct {
+	sync.Mutex
+	entries map[string]addressIDCacheEntry
+}{entries: map[string]addressIDCacheEntry{}}
+
+// An addressIDCacheEntry is an address ID in addressIDCache. The address ID is
+// empty if recollect doesn't know the address.
+type addressIDCacheEntry struct {
+	addressID string
+	expires   time.Time
+}
+
+// addressIDLookups collapses concurrent lookups of the same address into a
+// single recollect request
+var addressIDLookups singleflight.Group
+
+// getAddressID returns the address ID used by the recollect API. The address ID
+// is cached for addressIDCacheTTL. An address that isn't found is cached for
+// getNotFoundCacheTTL. Nothing is cached if isCacheEnabled is false.
+func getAddressID(ctx context.Context, client httpDoer, address string) (string, error) {
+	maxAddressLength := getIntEnv("MAX_ADDRESS_LENGTH", 200)
+	if len(address) > maxAddressLength {
+		log.Printf("The address is %d characters, which exceeds the maximum of %d", len(address), maxAddressLength)
+		return "", fmt.Errorf("%w: the address exceeds the maximum length of %d characters", errNotConfigured, maxAddressLength)
+	}
+
+	cacheEnabled := isCacheEnabled()
+	cacheKey := strings.ToLower(strings.Join(strings.Fields(address), " "))
+	addressIDCache.Lock()
+	entry, ok := addressIDCache.entries[cacheKey]
+	addressIDCache.Unlock()
+	if cacheEnabled && ok && now().Before(entry.expires) {
+		if entry.addressID == "" {
+			log.Print("Using the cached result that the address wasn't found")
+			return "", recollect.ErrAddressNotFound
+		}
+		log.Printf("Using the cached address ID of %s", entry.addressID)
+		return entry.addressID, nil
+	}
+
+	addressID, err, shared := addressIDLookups.Do(cacheKey, func() (interface{}, error) {
+		addressID, err := newRecollectClient(client, getServiceIDs()[0]).AddressID(ctx, getStreetLine(address))
+		if cacheEnabled && errors.Is(err, recollect.ErrAddressNotFound) {
+			// Only remember that the address wasn't found since other errors may be
+			// transient
+			addressIDCache.Lock()
+			addressIDCache.entries[cacheKey] = addressIDCacheEntry{expires: now().Add(getNotFoundCacheTTL())}
+			addressIDCache.Unlock()
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// A changed address ID may mean that recollect re-indexed its addresses
+		if ok && entry.addressID != "" && entry.addressID != addressID {
+			log.Printf("Warning: the address ID changed from %s to %s, which may change the schedule", entry.addressID, addressID)
+		}
+		if cacheEnabled {
+			addressIDCache.Lock()
+			addressIDCache.entries[cacheKey] = addressIDCacheEntry{addressID: addressID, expires: now().Add(addressIDCacheTTL)}
+			addressIDCache.Unlock()
+		}
+		return addressID, nil
+	})
+	if shared {
+		log.Print("Shared the address ID lookup with a concurrent request")
+	}
+	if err != nil {
+		return "", err
+	}
+	return addressID.(string), nil
+}
+
+// newRecollectClient returns a recollect client for the service ID. Its requests
+// are sent with doWithRetries. The recollect API URL is set with the
+// RECOLLECT_BASE_URL environment variable and defaults to
+// https://api.recollect.net. The area is set with the RECOLLECT_AREA environment
+// variable and defaults to CaryNC.
+func newRecollectClient(client httpDoer, serviceID string) *recollect.Client {
+	baseURL := os.Getenv("RECOLLECT_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.recollect.net"
+	}
+	area := os.Getenv("RECOLLECT_AREA")
+	if area == "" {
+		area = "CaryNC"
+	}
+
+	return &recollect.Client{
+		HTTPClient: retryingDoer{client},
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Area:       url.PathEscape(area),
+		ServiceID:  serviceID,
+	}
+}
+
+// retryingDoer sends HTTP requests with doWithRetries
+type retryingDoer struct {
+	client httpDoer
+}
+
+// Do sends the HTTP request with doWithRetries
+func (d retryingDoer) Do(req *http.Request) (*http.Response, error) {
+	return doWithRetries(d.client, req)
+}
+
+// doWithRetries sends the HTTP request and retries transient failures, which are
+// network errors and 429 and 5xx responses, with exponential backoff and jitter.
+// The number of retries is set with the MAX_RETRIES environment variable
+// (default 3) and the base delay with the RETRY_BASE_DELAY environment variable
+// (default 200ms). Retrying stops early if the delay would exceed the request's
+// context deadline.
+func doWithRetries(client httpDoer, req *http.Request) (*http.Response, error) {
+	maxRetries := 3
+	if value := os.Getenv("MAX_RETRIES"); value != "" {
+		if retries, err := strconv.Atoi(value); err == nil && retries >= 0 {
+			maxRetries = retries
+		} else {
+			log.Printf("The MAX_RETRIES environment variable is not a non-negative integer, so using %d", maxRetries)
+		}
+	}
+
+	baseDelay := 200 * time.Millisecond
+	if value := os.Getenv("RETRY_BASE_DELAY"); value != "" {
+		if delay, err := time.ParseDuration(value); err == nil && delay > 0 {
+			baseDelay = delay
+		} else {
+			log.Printf("The RETRY_BASE_DELAY environment variable is not a positive duration, so using %v", baseDelay)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		retryable := err != nil ||
+			resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		if !retryable || attempt >= maxRetries {
+			return resp, err
+		}
+
+		delay := baseDelay << attempt
+		delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			log.Printf("Not retrying the HTTP request since the deadline is in less than %v", delay)
+			return resp, err
+		}
+
+		if err != nil {
+			// Log the cause without the URL since its query may have the address
+			cause := err
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				cause = urlErr.Err
+			}
+			log.Printf("Retrying the HTTP request in %v after it failed: %v", delay, cause)
+		} else {
+			log.Printf("Retrying the HTTP request in %v after it failed with %s", delay, resp.Status)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			// Return a url.Error like the HTTP client does so that the caller knows
+			// that recollect couldn't be reached
+			op := req.Method[:1] + strings.ToLower(req.Method[1:])
+			return nil, &url.Error{Op: op, URL: req.URL.String(), Err: req.Context().Err()}
+		}
+	}
+}
+
+// getServiceIDs returns the recollect service IDs to query for curbside pick up
+// services. These can be set with the comma separated RECOLLECT_SERVICE_IDS
+// environment variable for addresses that are served by multiple providers.
+// Otherwise, this is the single service ID set with the RECOLLECT_SERVICE_ID
+// environment variable, which defaults to 1087, the Cary waste service.
+func getServiceIDs() []string {
+	serviceID := strings.TrimSpace(os.Getenv("RECOLLECT_SERVICE_ID"))
+	if serviceID == "" {
+		serviceID = "1087"
+	}
+	return getListEnv("RECOLLECT_SERVICE_IDS", []string{serviceID})
+}
+
+// validateServiceIDs returns an error if any of the service IDs from
+// getServiceIDs isn't numeric
+func validateServiceIDs() error {
+	for _, serviceID := range getServiceIDs() {
+		if _, err := strconv.ParseUint(serviceID, 10, 64); err != nil {
+			return fmt.Errorf("the recollect service ID %s is not numeric", serviceID)
+		}
+	}
+	return nil
+}
+
+// getServiceNames returns the recollect names of the curbside pick up services
+// in the area. These can be set with the comma separated SERVICE_NAMES
+// environment variable. This defaults to the Cary services.
+func getServiceNames() []string {
+	return getListEnv("SERVICE_NAMES", []string{"Garbage", "Recycling", "yardwaste", "looseleaf"})
+}
+
+// getIntEnv returns the positive integer value of the environment variable. The
+// default value is returned if the environment variable is unset or invalid.
+func getIntEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	intValue, err := strconv.Atoi(value)
+	if err != nil || intValue <= 0 {
+		log.Printf("The %s environment variable is not a positive integer, so using %d", name, defaultValue)
+		return defaultValue
+	}
+	return intValue
+}
+
+// getListEnv returns the values of the comma separated environment variable. The
+// default values are returned if the environment variable is unset or has no
+// values.
+func getListEnv(name string, defaultValues []string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	if len(values) == 0 {
+		return defaultValues
+	}
+	return values
+}
+
+// getUpcomingSchedule will query the recollect API to find the service
+// occurrences in the look ahead window from getLookaheadWindow. This returns a
+// slice of serviceOccurrence instances ordered by date in ascending order.
+func getUpcomingSchedule(ctx context.Context, client httpDoer, address string) ([]serviceOccurrence, error) {
+	after, before := getLookaheadWindow()
+	return scheduleBetween(ctx, client, address, after, before)
+}
+
+// getLookaheadWindow returns the after and before times of the look ahead
+// window starting now
+func getLookaheadWindow() (time.Time, time.Time) {
+	// Add a day count rather than a month since AddDate normalizes month overflows
+	// (e.g. January 31 plus a month is March 3)
+	now := localNow()
+	return now, now.AddDate(0, 0, getLookaheadDays())
+}
+
+// location is the time zone of the curbside pick up schedule, which is loaded
+// once by getLocation
+var location struct {
+	once sync.Once
+	loc  *time.Location
+}
+
+// getLocation returns the time zone of the curbside pick up schedule. This is
+// set with the TIME_ZONE environment variable and defaults to America/New_York
+// since the recollect days are local Cary dates and Lambda runs in UTC.
+func getLocation() *time.Location {
+	location.once.Do(func() {
+		name := os.Getenv("TIME_ZONE")
+		if name == "" {
+			name = "America/New_York"
+		}
+
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			log.Printf("The TIME_ZONE environment variable is not a valid time zone, so using America/New_York: %v", err)
+			loc, _ = time.LoadLocation("America/New_York")
+		}
+		location.loc = loc
+	})
+	return location.loc
+}
+
+// now returns the current time. This is replaced in tests to fake the clock.
+var now = time.Now
+
+// localNow returns the current time in the time zone from getLocation
+func localNow() time.Time {
+	return now().In(getLocation())
+}
+
+// getLookaheadDays returns the number of days to look ahead for curbside pick up
+// services. This is set with the LOOKAHEAD_DAYS environment variable and
+// defaults to 30.
+func getLookaheadDays() int {
+	return getIntEnv("LOOKAHEAD_DAYS", 30)
+}
+
+// scheduleBetween will query the recollect API to find the service occurrences
+// between the after and before days. The occurrences of all the configured
+// service IDs are merged. This returns a slice of serviceOccurrence instances
+// ordered by date in ascending order.
+func scheduleBetween(ctx context.Context, client httpDoer, address string, afterTime time.Time, beforeTime time.Time) ([]serviceOccurrence, error) {
+	occurrences, _, err := scheduleAndNoticesBetween(ctx, client, address, afterTime, beforeTime)
+	return occurrences, err
+}
+
+// scheduleAndNoticesBetween is like scheduleBetween but also returns the
+// recollect events that aren't curbside pick up services (e.g. street sweeping)
+// as notices ordered by date in ascending order
+func scheduleAndNoticesBetween(ctx context.Context, client httpDoer, address string, afterTime time.Time, beforeTime time.Time) ([]serviceOccurrence, []serviceOccurrence, error) {
+	addressID, err := getAddressID(ctx, client, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type serviceResult struct {
+		occurrences []serviceOccurrence
+		notices     []serviceOccurrence
+		err         error
+	}
+	serviceIDs := getServiceIDs()
+	results := make([]serviceResult, len(serviceIDs))
+	var wg sync.WaitGroup
+	for i, serviceID := range serviceIDs {
+		wg.Add(1)
+		go func(i int, serviceID string) {
+			defer wg.Done()
+			occurrences, notices, err := getServiceOccurrences(ctx, client, addressID, serviceID, afterTime, beforeTime)
+			results[i] = serviceResult{occurrences, notices, err}
+		}(i, serviceID)
+	}
+	wg.Wait()
+
+	var occurrences []serviceOccurrence
+	var notices []serviceOccurrence
+	seen := map[string]bool{}
+	seenNotices := map[string]bool{}
+	for _, result := range results {
+		if result.err != nil {
+			return nil, nil, result.err
+		}
+
+		for _, occurrence := range result.occurrences {
+			// Providers may both report the same service on the same day and an
+			// event may be repeated
+			key := occurrence.key()
+			if !seen[key] {
+				seen[key] = true
+				occurrences = append(occurrences, occurrence)
+			}
+		}
+
+		for _, notice := range result.notices {
+			key := notice.key()
+			if !seenNotices[key] {
+				seenNotices[key] = true
+				notices = append(notices, notice)
+			}
+		}
+	}
+
+	// The recollect API doesn't document the order of the events
+	sortOccurrences(occurrences)
+	sortOccurrences(notices)
+
+	return occurrences, notices, nil
+}
+
+// sortOccurrences sorts the occurrences by day in ascending order and then by
+// the case insensitive name so that the order doesn't depend on the recollect
+// API or the order of the service IDs
+func sortOccurrences(occurrences []serviceOccurrence) {
+	sort.Slice(occurrences, func(i, j int) bool {
+		if occurrences[i].day != occurrences[j].day {
+			// The days are in the 2021-06-22 format, which sorts chronologically
+			return occurrences[i].day < occurrences[j].day
+		}
+		return strings.ToLower(occurrences[i].name) < strings.ToLower(occurrences[j].name)
+	})
+}
+
+// getServiceOccurrences will query the recollect API to find the occurrences of
+// the service ID between the after and before days. The events that aren't
+// curbside pick up services are returned as notices.
+func getServiceOccurrences(ctx context.Context, client httpDoer, addressID string, serviceID string, after time.Time, before time.Time) ([]serviceOccurrence, []serviceOccurrence, error) {
+	events, err := newRecollectClient(client, serviceID).Schedule(ctx, addressID, after, before)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Some recollect areas don't set the service name on the flags, in which case
+	// the flags with known service names are considered curbside pick up services
+	hasServiceNames := false
+	for _, event := range events {
+		for _, flag := range event.Flags {
+			if flag.ServiceName != "" {
+				hasServiceNames = true
+			}
+		}
+	}
+	knownServiceNames := map[string]bool{}
+	if !hasServiceNames {
+		log.Print("The schedule lookup response has no service names on the flags")
+		for _, name := range getServiceNames() {
+			knownServiceNames[strings.ToLower(name)] = true
+		}
+	}
+
+	var occurrences []serviceOccurrence
+	var notices []serviceOccurrence
+	for _, event := range events {
+		title := event.Title
+		if title == "" {
+			title = event.Description
+		}
+
+		// An event may have several waste flags, so each distinct one is a service
+		foundServices := map[string]bool{}
+		for _, flag := range event.Flags {
+			if flag.ServiceName == "waste" || knownServiceNames[strings.ToLower(flag.Name)] {
+				if foundServices[strings.ToLower(flag.Name)] {
+					continue
+				}
+				foundServices[strings.ToLower(flag.Name)] = true
+				occurrences = append(occurrences, serviceOccurrence{day: event.Day, name: flag.Name, title: title})
+			} else if flag.ServiceName != "" {
+				notices = append(notices, serviceOccurrence{day: event.Day, name: flag.Name, title: title})
+			}
+		}
+	}
+
+	return occurrences, notices, nil
+}
+
+// main starts AWS Lambda on the intentDispatcher function
+func main() {
+	// Seed the retry jitter so that containers don't retry in lockstep
+	rand.Seed(time.Now().UnixNano())
+	if err := validateServiceIDs(); err != nil {
+		log.Fatalf("The skill is not configured correctly: %v", err)
+	}
+	address := flag.String("address", "", "answer the query for the street address and exit instead of running in AWS Lambda")
+	query := flag.String("query", "next", `the query to answer for -address, which is "next" or a collection type (e.g. recycling)`)
+	flag.Parse()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if *address != "" {
+		if err := runCLI(context.Background(), client, *address, *query); err != nil {
+			log.Fatalf("Failed to answer the query: %v", err)
+		}
+		return
+	}
+
+	lambda.Start(func(ctx context.Context, request skillRequest) (interface{}, error) {
+		return intentDispatcher(ctx, client, request)
+	})
 }
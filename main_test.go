@@ -0,0 +1,2630 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arienmalec/alexa-go"
+	"github.com/mprahl/cary-curbside-pick-up/recollect"
+)
+
+func TestMain(m *testing.M) {
+	// The time zone is loaded once, so load the default America/New_York before
+	// any test sets the TIME_ZONE environment variable
+	os.Unsetenv("TIME_ZONE")
+	getLocation()
+	os.Exit(m.Run())
+}
+
+func TestJoinServices(t *testing.T) {
+	tests := []struct {
+		serviceNames []string
+		expected     string
+	}{
+		{nil, ""},
+		{[]string{"garbage"}, "garbage"},
+		{[]string{"garbage", "recycling"}, "garbage and recycling"},
+		{[]string{"garbage", "recycling", "yard waste"}, "garbage, recycling, and yard waste"},
+		{
+			[]string{"garbage", "recycling", "yard waste", "leaf collection"},
+			"garbage, recycling, yard waste, and leaf collection",
+		},
+	}
+
+	for _, test := range tests {
+		if actual := joinServices(test.serviceNames); actual != test.expected {
+			t.Errorf("joinServices(%q) = %q, expected %q", test.serviceNames, actual, test.expected)
+		}
+	}
+}
+
+// doerFunc is an httpDoer that sends the HTTP requests with the function
+type doerFunc func(req *http.Request) (*http.Response, error)
+
+// Do sends the HTTP request with the function
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// setenv sets the environment variable for the duration of the test
+func setenv(t *testing.T, name string, value string) {
+	oldValue, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, oldValue)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// newStatusResponse returns an HTTP response with the status code and no body
+func newStatusResponse(statusCode int) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+}
+
+func TestDoWithRetriesCanceled(t *testing.T) {
+	setenv(t, "MAX_RETRIES", "3")
+	setenv(t, "RETRY_BASE_DELAY", "1h")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		// Cancel the request during the backoff
+		cancel()
+		return newStatusResponse(http.StatusServiceUnavailable), nil
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.recollect.net/api/places", nil)
+	if err != nil {
+		t.Fatalf("failed to create the request: %v", err)
+	}
+
+	_, err = doWithRetries(client, req)
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a url.Error of the canceled context, got %#v", err)
+	}
+	if urlErr.Op != "Get" || urlErr.URL != "https://api.recollect.net/api/places" {
+		t.Errorf("unexpected url.Error: %v", urlErr)
+	}
+}
+
+func TestIntentDispatcherFallbackMessageAfterRetries(t *testing.T) {
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setenv(t, "FALLBACK_MESSAGE", "I can't reach the schedule right now.")
+	setenv(t, "MAX_RETRIES", "3")
+	setenv(t, "RETRY_BASE_DELAY", "1h")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		cancel()
+		return newStatusResponse(http.StatusBadGateway), nil
+	})
+
+	var request skillRequest
+	request.Body.Type = "IntentRequest"
+	request.Body.Intent.Name = "WhatIsNext"
+	response, err := intentDispatcher(ctx, client, request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	speech := response.(alexa.Response).Body.OutputSpeech.Text
+	if speech != "I can't reach the schedule right now." {
+		t.Errorf("expected the fallback message, got %q", speech)
+	}
+}
+
+func TestDoWithRetriesAttempts(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries string
+		statusCode int
+		attempts   int
+	}{
+		{"configured retries", "2", http.StatusServiceUnavailable, 3},
+		{"no retries", "0", http.StatusServiceUnavailable, 1},
+		{"invalid retries use the default", "many", http.StatusServiceUnavailable, 4},
+		{"too many requests", "1", http.StatusTooManyRequests, 2},
+		{"not retryable", "3", http.StatusNotFound, 1},
+		{"success", "3", http.StatusOK, 1},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "MAX_RETRIES", test.maxRetries)
+			setenv(t, "RETRY_BASE_DELAY", "1ms")
+
+			attempts := 0
+			client := doerFunc(func(req *http.Request) (*http.Response, error) {
+				attempts++
+				return newStatusResponse(test.statusCode), nil
+			})
+
+			req, err := http.NewRequest(http.MethodGet, "https://api.recollect.net/api/places", nil)
+			if err != nil {
+				t.Fatalf("failed to create the request: %v", err)
+			}
+
+			resp, err := doWithRetries(client, req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.StatusCode != test.statusCode {
+				t.Errorf("expected the last response's status code %d, got %d", test.statusCode, resp.StatusCode)
+			}
+			if attempts != test.attempts {
+				t.Errorf("expected %d attempts, got %d", test.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestDoWithRetriesBaseDelay(t *testing.T) {
+	setenv(t, "MAX_RETRIES", "2")
+	setenv(t, "RETRY_BASE_DELAY", "20ms")
+
+	var attemptTimes []time.Time
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		attemptTimes = append(attemptTimes, time.Now())
+		return nil, errors.New("connection refused")
+	})
+
+	req, err := http.NewRequest(http.MethodGet, "https://api.recollect.net/api/places", nil)
+	if err != nil {
+		t.Fatalf("failed to create the request: %v", err)
+	}
+
+	if _, err := doWithRetries(client, req); err == nil {
+		t.Fatal("expected the error of the last attempt")
+	}
+	if len(attemptTimes) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attemptTimes))
+	}
+	// The delay doubles after each attempt
+	for i, minDelay := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if delay := attemptTimes[i+1].Sub(attemptTimes[i]); delay < minDelay {
+			t.Errorf("expected retry %d to wait at least %v, waited %v", i+1, minDelay, delay)
+		}
+	}
+}
+
+func TestDoWithRetriesDeadline(t *testing.T) {
+	setenv(t, "MAX_RETRIES", "3")
+	setenv(t, "RETRY_BASE_DELAY", "1h")
+
+	attempts := 0
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return newStatusResponse(http.StatusServiceUnavailable), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.recollect.net/api/places", nil)
+	if err != nil {
+		t.Fatalf("failed to create the request: %v", err)
+	}
+
+	resp, err := doWithRetries(client, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || attempts != 1 {
+		t.Errorf("expected a single attempt since the delay exceeds the deadline, got %d", attempts)
+	}
+}
+
+// setNow fakes the current time for the duration of the test
+func setNow(t *testing.T, fakeNow time.Time) {
+	now = func() time.Time { return fakeNow }
+	t.Cleanup(func() { now = time.Now })
+}
+
+// resetAddressIDCache empties the address ID cache before and after the test
+func resetAddressIDCache(t *testing.T) {
+	reset := func() {
+		addressIDCache.Lock()
+		addressIDCache.entries = map[string]addressIDCacheEntry{}
+		addressIDCache.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// newTestRecollect starts a test recollect API served by the handler and
+// configures the skill to use it without retries
+func newTestRecollect(t *testing.T, handler http.HandlerFunc) httpDoer {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	setenv(t, "RECOLLECT_BASE_URL", server.URL)
+	setenv(t, "MAX_RETRIES", "0")
+	resetAddressIDCache(t)
+	return server.Client()
+}
+
+// eventsHandler returns a test recollect API handler that suggests the place ID
+// ABC123 for any address and responds with an event per occurrence
+func eventsHandler(occurrences ...serviceOccurrence) http.HandlerFunc {
+	var events []recollect.Event
+	for _, occurrence := range occurrences {
+		events = append(events, recollect.Event{
+			Day: occurrence.day, Flags: []recollect.Flag{{Name: occurrence.name, ServiceName: "waste"}},
+		})
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/address-suggest") {
+			w.Write([]byte(`[{"place_id": "ABC123"}]`))
+			return
+		}
+		json.NewEncoder(w).Encode(recollect.EventJSON{Events: events})
+	}
+}
+
+// rawEventsHandler returns a test recollect API handler that suggests the place
+// ID ABC123 for any address and responds with the events JSON as is
+func rawEventsHandler(eventsJSON string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/address-suggest") {
+			w.Write([]byte(`[{"place_id": "ABC123"}]`))
+			return
+		}
+		w.Write([]byte(eventsJSON))
+	}
+}
+
+func TestLookaheadWindowLateEvening(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "LOOKAHEAD_DAYS", "30")
+	// 11:30pm Eastern on Monday, June 21, 2021 is already Tuesday in UTC
+	setNow(t, time.Date(2021, 6, 22, 3, 30, 0, 0, time.UTC))
+
+	after, before := getLookaheadWindow()
+	if day := after.Format("2006-01-02"); day != "2021-06-21" {
+		t.Errorf("expected the window to start on the local day 2021-06-21, got %s", day)
+	}
+	if day := before.Format("2006-01-02"); day != "2021-07-21" {
+		t.Errorf("expected the window to end on 2021-07-21, got %s", day)
+	}
+
+	var eventsQuery url.Values
+	handler := eventsHandler(
+		serviceOccurrence{day: "2021-06-21", name: "Garbage"}, serviceOccurrence{day: "2021-06-22", name: "Recycling"},
+	)
+	client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/events") {
+			eventsQuery = r.URL.Query()
+		}
+		handler(w, r)
+	})
+
+	answer, err := handleRoutineSummary(context.Background(), client, "1260 NW Maynard Rd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if eventsQuery.Get("after") != "2021-06-21" || eventsQuery.Get("before") != "2021-07-21" {
+		t.Errorf("expected the events from 2021-06-21 to 2021-07-21, got %v", eventsQuery)
+	}
+	// Today's pick up is still today in Cary even though it's tomorrow in UTC
+	if answer.Speech != "Today is garbage." {
+		t.Errorf("expected today's pick up, got %q", answer.Speech)
+	}
+}
+
+func TestRelativeDayPhraseNearMidnight(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeZone string
+		now      time.Time
+		day      string
+		expected string
+	}{
+		{"noon without a time zone", "", time.Date(2021, 6, 21, 16, 0, 0, 0, time.UTC), "2021-06-22", "tomorrow"},
+		{"11:30pm without a time zone", "", time.Date(2021, 6, 22, 3, 30, 0, 0, time.UTC), "2021-06-22", "Tuesday, June 22"},
+		{"12:30am without a time zone", "", time.Date(2021, 6, 22, 4, 30, 0, 0, time.UTC), "2021-06-22", "Tuesday, June 22"},
+		{"11:30pm with UTC", "UTC", time.Date(2021, 6, 22, 3, 30, 0, 0, time.UTC), "2021-06-21", "Monday, June 21"},
+		{"11:30pm with a time zone", "America/New_York", time.Date(2021, 6, 22, 3, 30, 0, 0, time.UTC), "2021-06-22", "tomorrow"},
+		{"12:30am with a time zone", "America/New_York", time.Date(2021, 6, 22, 4, 30, 0, 0, time.UTC), "2021-06-22", "today"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", test.timeZone)
+			setNow(t, test.now)
+
+			if actual := relativeDayPhrase(test.day); actual != test.expected {
+				t.Errorf("relativeDayPhrase(%q) = %q, expected %q", test.day, actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestWhatIsNextEveningMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		now      time.Time
+		expected string
+	}{
+		{
+			"before the evening", time.Date(2021, 6, 21, 22, 0, 0, 0, time.UTC),
+			"Today, on Monday, June 21, 2021, there will be curb side pick up for: garbage.",
+		},
+		{
+			"after the evening starts", time.Date(2021, 6, 22, 0, 0, 0, 0, time.UTC),
+			"Tomorrow, Tuesday, June 22, 2021, there will be curb side pick up for: recycling.",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "EVENING_MODE_AFTER", "19:00")
+			setNow(t, test.now)
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-21", name: "Garbage"}, serviceOccurrence{day: "2021-06-22", name: "Recycling"},
+			))
+
+			answer, err := handleWhatIsNext(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+// newIntentRequest returns an Alexa intent request with the slot values
+func newIntentRequest(intentName string, slotValues map[string]string) skillRequest {
+	var request skillRequest
+	request.Body.Type = "IntentRequest"
+	request.Body.Intent.Name = intentName
+	request.Body.Intent.Slots = map[string]alexa.Slot{}
+	for name, value := range slotValues {
+		request.Body.Intent.Slots[name] = alexa.Slot{Name: name, Value: value}
+	}
+	return request
+}
+
+func TestQuietHours(t *testing.T) {
+	tests := []struct {
+		name     string
+		now      time.Time
+		intent   string
+		slots    map[string]string
+		expected string
+		reprompt bool
+	}{
+		{
+			"outside quiet hours", time.Date(2021, 6, 22, 0, 0, 0, 0, time.UTC), "WhatIsNext", nil,
+			"On Tuesday, June 22, 2021, there will be curb side pick up for: garbage.", false,
+		},
+		{"inside quiet hours", time.Date(2021, 6, 22, 3, 0, 0, 0, time.UTC), "WhatIsNext", nil, "Tomorrow is garbage.", false},
+		{
+			"clarification outside quiet hours", time.Date(2021, 6, 22, 0, 0, 0, 0, time.UTC), "Frequency",
+			map[string]string{"collectionType": "yard"}, "Did you mean leaf collection or yard waste?", true,
+		},
+		{
+			"clarification inside quiet hours", time.Date(2021, 6, 22, 3, 0, 0, 0, time.UTC), "Frequency",
+			map[string]string{"collectionType": "yard"}, "Did you mean leaf collection or yard waste?", false,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "QUIET_HOURS", "22:00-07:00")
+			setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+			// 8pm and 11pm Eastern
+			setNow(t, test.now)
+			client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: "2021-06-22", name: "Garbage"}))
+
+			response, err := intentDispatcher(context.Background(), client, newIntentRequest(test.intent, test.slots))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			body := response.(alexa.Response).Body
+			if body.Card.Content != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, body.Card.Content)
+			}
+			if hasReprompt := body.Reprompt != nil; hasReprompt != test.reprompt || body.ShouldEndSession == test.reprompt {
+				t.Errorf("expected a reprompt to be %v, got %v", test.reprompt, hasReprompt)
+			}
+		})
+	}
+}
+
+func TestOverLengthAddress(t *testing.T) {
+	setenv(t, "STREET_ADDRESS", strings.Repeat("1260 NW Maynard Rd ", 20))
+	setenv(t, "MAX_ADDRESS_LENGTH", "200")
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		t.Fatalf("unexpected HTTP request to %s", req.URL)
+		return nil, nil
+	})
+
+	response, err := intentDispatcher(context.Background(), client, newIntentRequest("WhatIsNext", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	speech := response.(alexa.Response).Body.OutputSpeech.Text
+	if speech != "Sorry, the skill is not configured correctly." {
+		t.Errorf("expected the not configured message, got %q", speech)
+	}
+}
+
+func TestGetAddressIDConcurrentLookups(t *testing.T) {
+	var suggestCalls int32
+	handler := eventsHandler()
+	client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&suggestCalls, 1)
+		// Give the other lookups time to wait on this one
+		time.Sleep(50 * time.Millisecond)
+		handler(w, r)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addressID, err := getAddressID(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil || addressID != "ABC123" {
+				t.Errorf("expected the address ID ABC123, got %q and the error %v", addressID, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if suggestCalls := atomic.LoadInt32(&suggestCalls); suggestCalls != 1 {
+		t.Errorf("expected a single address suggest request, got %d", suggestCalls)
+	}
+}
+
+func TestGetAddressIDPanic(t *testing.T) {
+	resetAddressIDCache(t)
+	panicked := false
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		if !panicked {
+			panicked = true
+			panic("the HTTP client panicked")
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`[{"place_id": "ABC123"}]`)),
+		}, nil
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected the address ID lookup to panic")
+			}
+		}()
+		getAddressID(context.Background(), client, "1260 NW Maynard Rd")
+	}()
+
+	// The panicked lookup must not block the later lookups of the address
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	addressID, err := getAddressID(ctx, client, "1260 NW Maynard Rd")
+	if err != nil || addressID != "ABC123" {
+		t.Errorf("expected the address ID ABC123, got %q and the error %v", addressID, err)
+	}
+}
+
+func TestGetAddressIDNotFoundCache(t *testing.T) {
+	setenv(t, "NOT_FOUND_CACHE_TTL", "5m")
+	setNow(t, time.Date(2021, 6, 21, 16, 0, 0, 0, time.UTC))
+	suggestCalls := 0
+	client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+		suggestCalls++
+		w.Write([]byte(`[]`))
+	})
+
+	for _, elapsed := range []time.Duration{0, 4 * time.Minute, 6 * time.Minute} {
+		setNow(t, time.Date(2021, 6, 21, 16, 0, 0, 0, time.UTC).Add(elapsed))
+		if _, err := getAddressID(context.Background(), client, "1 Nowhere Rd"); !errors.Is(err, recollect.ErrAddressNotFound) {
+			t.Fatalf("expected the address to not be found after %v, got %v", elapsed, err)
+		}
+	}
+
+	// The lookup within the TTL is cached, but the one after the TTL is retried
+	if suggestCalls != 2 {
+		t.Errorf("expected 2 address suggest requests, got %d", suggestCalls)
+	}
+}
+
+func TestGetAddressIDTransientErrorNotCached(t *testing.T) {
+	suggestCalls := 0
+	client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+		suggestCalls++
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := getAddressID(context.Background(), client, "1260 NW Maynard Rd"); err == nil {
+			t.Fatal("expected the address lookup to fail")
+		}
+	}
+
+	if suggestCalls != 2 {
+		t.Errorf("expected 2 address suggest requests since failures aren't cached, got %d", suggestCalls)
+	}
+}
+
+func TestCacheBackend(t *testing.T) {
+	tests := []struct {
+		backend      string
+		suggestCalls int
+	}{
+		{"", 1},
+		{"memory", 1},
+		{"none", 3},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run("backend "+test.backend, func(t *testing.T) {
+			setenv(t, "CACHE_BACKEND", test.backend)
+			suggestCalls := 0
+			handler := eventsHandler()
+			client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+				suggestCalls++
+				handler(w, r)
+			})
+
+			for i := 0; i < 3; i++ {
+				if _, err := getAddressID(context.Background(), client, "1260 NW Maynard Rd"); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			if suggestCalls != test.suggestCalls {
+				t.Errorf("expected %d address suggest requests, got %d", test.suggestCalls, suggestCalls)
+			}
+		})
+	}
+}
+
+func TestUnknownIntentMakesNoHTTPRequests(t *testing.T) {
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		t.Fatalf("unexpected HTTP request to %s", req.URL)
+		return nil, nil
+	})
+
+	// The device can provide its address, which must not be looked up either
+	request := newIntentRequest("TellMeAJoke", nil)
+	request.DeviceContext.System.APIEndpoint = "https://api.amazonalexa.com"
+	request.DeviceContext.System.APIAccessToken = "token"
+	request.DeviceContext.System.Device.DeviceID = "amzn1.ask.device.ABC"
+
+	response, err := intentDispatcher(context.Background(), client, request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body := response.(alexa.Response).Body
+	if body.Card.Title != "Unknown Request" || body.OutputSpeech.Text != "The intent was unrecognized" {
+		t.Errorf("expected the unknown request response, got %+v", body.OutputSpeech)
+	}
+}
+
+func TestIntentDispatcherConcurrent(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(
+		serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+		serviceOccurrence{day: "2021-06-21", name: "Recycling"},
+		serviceOccurrence{day: "2021-06-28", name: "Garbage"},
+	))
+
+	requests := []skillRequest{
+		newIntentRequest("GetSchedule", map[string]string{"collectionType": "recycling"}),
+		newIntentRequest("WhatIsNext", nil),
+	}
+	expected := []string{
+		"Curbside pick up for recycling is on Monday, June 21, 2021.",
+		"On Monday, June 21, 2021, there will be curb side pick up for: garbage and recycling.",
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := intentDispatcher(context.Background(), client, requests[i%len(requests)])
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if content := response.(alexa.Response).Body.Card.Content; content != expected[i%len(expected)] {
+				t.Errorf("expected %q, got %q", expected[i%len(expected)], content)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestScheduleBetweenDeduplicates(t *testing.T) {
+	// The garbage flag is repeated in the event and the event is repeated
+	client := newTestRecollect(t, rawEventsHandler(`{"events": [
+		{"day": "2021-06-21", "flags": [
+			{"name": "Garbage", "service_name": "waste"}, {"name": "Garbage", "service_name": "waste"}
+		]},
+		{"day": "2021-06-21", "flags": [{"name": "garbage", "service_name": "waste"}]}
+	]}`))
+
+	after := time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)
+	occurrences, err := scheduleBetween(context.Background(), client, "1260 NW Maynard Rd", after, after.AddDate(0, 0, 30))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(occurrences) != 1 || occurrences[0].day != "2021-06-21" || occurrences[0].GetName() != "Garbage" {
+		t.Errorf("expected a single garbage occurrence on 2021-06-21, got %+v", occurrences)
+	}
+}
+
+func TestWhatIsNextOutOfOrderEvents(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(
+		serviceOccurrence{day: "2021-06-28", name: "Garbage"},
+		serviceOccurrence{day: "2021-06-21", name: "Recycling"},
+		serviceOccurrence{day: "2021-06-24", name: "yardwaste"},
+		serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+	))
+
+	answer, err := handleWhatIsNext(context.Background(), client, "1260 NW Maynard Rd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []answerOccurrence{{Day: "2021-06-21", Service: "Garbage"}, {Day: "2021-06-21", Service: "Recycling"}}
+	if !reflect.DeepEqual(answer.Occurrences, expected) {
+		t.Errorf("expected the earliest occurrences %+v, got %+v", expected, answer.Occurrences)
+	}
+}
+
+func TestSortOccurrences(t *testing.T) {
+	occurrences := []serviceOccurrence{
+		{day: "2021-06-28", name: "Garbage"},
+		{day: "2021-06-21", name: "Recycling"},
+		{day: "2021-06-21", name: "yardwaste"},
+		{day: "2021-06-21", name: "Garbage"},
+	}
+	sortOccurrences(occurrences)
+
+	expected := []serviceOccurrence{
+		{day: "2021-06-21", name: "Garbage"},
+		{day: "2021-06-21", name: "Recycling"},
+		{day: "2021-06-21", name: "yardwaste"},
+		{day: "2021-06-28", name: "Garbage"},
+	}
+	if !reflect.DeepEqual(occurrences, expected) {
+		t.Errorf("expected %+v, got %+v", expected, occurrences)
+	}
+}
+
+func TestListScheduleGrouping(t *testing.T) {
+	tests := []struct {
+		grouping string
+		speech   string
+		card     string
+	}{
+		{
+			"by-service",
+			"Next garbage is Monday June 21, next recycling is Monday June 21, and next yard waste is Thursday June 24.",
+			"Garbage: Monday, June 21, 2021\nRecycling: Monday, June 21, 2021\nYard Waste: Thursday, June 24, 2021",
+		},
+		{
+			"by-day",
+			"Monday June 21 is garbage and recycling and Thursday June 24 is yard waste.",
+			"Monday, June 21, 2021: garbage and recycling\nThursday, June 24, 2021: yard waste",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.grouping, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "SERVICE_NAMES", "Garbage,Recycling,yardwaste")
+			setenv(t, "LIST_GROUPING", test.grouping)
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+				serviceOccurrence{day: "2021-06-21", name: "Recycling"},
+				serviceOccurrence{day: "2021-06-24", name: "yardwaste"},
+				serviceOccurrence{day: "2021-06-28", name: "Garbage"},
+			))
+
+			answer, err := handleListSchedule(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.speech {
+				t.Errorf("expected the speech %q, got %q", test.speech, answer.Speech)
+			}
+			if answer.CardBody != test.card {
+				t.Errorf("expected the card %q, got %q", test.card, answer.CardBody)
+			}
+		})
+	}
+}
+
+func TestResolveServiceType(t *testing.T) {
+	occurrences := []serviceOccurrence{
+		{day: "2021-06-21", name: "Garbage"},
+		{day: "2021-06-21", name: "Food Waste"},
+		{day: "2021-06-24", name: "yardwaste"},
+	}
+	tests := []struct {
+		name          string
+		serviceType   string
+		serviceName   string
+		clarification string
+	}{
+		{"exact match", "garbage", "Garbage", ""},
+		{"recollect service name", "yardwaste", "Yard Waste", ""},
+		{"ambiguous", "waste", "", "Did you mean food waste or yard waste?"},
+		{"no match", "recycling", "", ""},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			serviceName, clarification, ok := resolveServiceType("GetSchedule", test.serviceType, occurrences)
+			if serviceName != test.serviceName {
+				t.Errorf("expected the service name %q, got %q", test.serviceName, serviceName)
+			}
+			if ok != (test.clarification != "") || clarification.Speech != test.clarification {
+				t.Errorf("expected the clarification %q, got %q", test.clarification, clarification.Speech)
+			}
+			if ok && clarification.PendingIntent != "GetSchedule" {
+				t.Errorf("expected the pending intent GetSchedule, got %q", clarification.PendingIntent)
+			}
+		})
+	}
+}
+
+func TestMissedPickup(t *testing.T) {
+	tests := []struct {
+		serviceType string
+		expected    string
+	}{
+		{"garbage", "Yes, garbage was collected Monday."},
+		{"recycling", "No, recycling is still coming up Friday."},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.serviceType, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			// Noon on Wednesday, June 23, 2021 in Cary
+			setNow(t, time.Date(2021, 6, 23, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+				serviceOccurrence{day: "2021-06-25", name: "Recycling"},
+			))
+
+			answer, err := handleMissedPickup(context.Background(), client, "1260 NW Maynard Rd", test.serviceType)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestListScheduleMaxSpeechDays(t *testing.T) {
+	tests := []struct {
+		grouping string
+		speech   string
+		card     string
+	}{
+		{
+			"by-service",
+			"Next garbage is Monday June 21, next recycling is Monday June 21, and 2 more pick up days; see the card.",
+			"Garbage: Mon 6/21\nRecycling: Mon 6/21\nYard Waste: Thu 6/24\nLeaf Collection: Fri 6/25",
+		},
+		{
+			"by-day",
+			"Monday June 21 is garbage and recycling and 2 more pick up days; see the card.",
+			"Mon 6/21: garbage and recycling\nThu 6/24: yard waste\nFri 6/25: leaf collection",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.grouping, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "LIST_GROUPING", test.grouping)
+			setenv(t, "MAX_SPEECH_DAYS", "1")
+			setenv(t, "CARD_DATE_FORMAT", "compact")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+				serviceOccurrence{day: "2021-06-21", name: "Recycling"},
+				serviceOccurrence{day: "2021-06-24", name: "yardwaste"},
+				serviceOccurrence{day: "2021-06-25", name: "looseleaf"},
+			))
+
+			answer, err := handleListSchedule(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// Only the first day is spoken, but the card has every service
+			if answer.Speech != test.speech {
+				t.Errorf("expected the speech %q, got %q", test.speech, answer.Speech)
+			}
+			if answer.CardBody != test.card {
+				t.Errorf("expected the card %q, got %q", test.card, answer.CardBody)
+			}
+		})
+	}
+}
+
+func TestLeafOrYardWasteClarification(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(
+		serviceOccurrence{day: "2021-06-24", name: "yardwaste"},
+		serviceOccurrence{day: "2021-07-01", name: "yardwaste"},
+		serviceOccurrence{day: "2021-07-08", name: "yardwaste"},
+	))
+
+	response, err := intentDispatcher(context.Background(), client, newIntentRequest("Frequency", map[string]string{"collectionType": "yard"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	clarification := response.(alexa.Response)
+	if clarification.Body.OutputSpeech.Text != "Did you mean leaf collection or yard waste?" {
+		t.Errorf("expected the clarification question, got %q", clarification.Body.OutputSpeech.Text)
+	}
+
+	// The answer to the question only has the collection type, which is matched to
+	// the GetSchedule intent
+	request := newIntentRequest("GetSchedule", map[string]string{"collectionType": "yard waste"})
+	request.Session.Attributes = clarification.SessionAttributes
+	response, err = intentDispatcher(context.Background(), client, request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if speech := response.(alexa.Response).Body.OutputSpeech.Text; speech != "Yard Waste is picked up weekly." {
+		t.Errorf("expected the Frequency answer for yard waste, got %q", speech)
+	}
+}
+
+func TestLeafOrYardWasteNotConfigured(t *testing.T) {
+	setenv(t, "SERVICE_NAMES", "Garbage,Recycling,Organics")
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		t.Fatalf("unexpected HTTP request to %s", req.URL)
+		return nil, nil
+	})
+
+	answer, err := handleFrequency(context.Background(), client, "1260 NW Maynard Rd", "yard")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Neither leaf collection nor yard waste is offered since they aren't configured
+	expected := "I don't recognize the collection type yard. Try garbage, recycling, or organics."
+	if answer.Speech != expected || answer.Reprompt != "" {
+		t.Errorf("expected %q without a reprompt, got %q", expected, answer.Speech)
+	}
+}
+
+func TestConfiguredServiceNames(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setenv(t, "SERVICE_NAMES", "Garbage,Recycling,Organics")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(
+		serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+		serviceOccurrence{day: "2021-06-22", name: "Organics"},
+	))
+
+	tests := []struct {
+		name     string
+		request  skillRequest
+		expected string
+	}{
+		{
+			"configured service", newIntentRequest("GetSchedule", map[string]string{"collectionType": "organics"}),
+			"Curbside pick up for organics is on Tuesday, June 22, 2021.",
+		},
+		{
+			"unknown service", newIntentRequest("GetSchedule", map[string]string{"collectionType": "compost"}),
+			"I don't recognize the collection type compost. Try garbage, recycling, or organics.",
+		},
+		{
+			"help", newIntentRequest("AMAZON.HelpIntent", nil),
+			"You can say things like what's next or when's recycling. " +
+				"The supported collection types are: garbage, recycling, and organics.",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			response, err := intentDispatcher(context.Background(), client, test.request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if content := response.(alexa.Response).Body.Card.Content; content != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, content)
+			}
+		})
+	}
+}
+
+func TestShowEventTitles(t *testing.T) {
+	tests := []struct {
+		name        string
+		showTitles  string
+		serviceType string
+		expected    string
+	}{
+		{
+			"what is next", "true", "",
+			"On Mon 6/21, there will be curb side pick up for: garbage and recycling.\nHoliday schedule",
+		},
+		{"get schedule", "true", "garbage", "Mon 6/21\nMon 6/28\nHoliday schedule\nLeaf collection - final pass"},
+		{"disabled", "false", "garbage", "Mon 6/21\nMon 6/28"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "SHOW_EVENT_TITLES", test.showTitles)
+			setenv(t, "CARD_DATE_FORMAT", "compact")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			// The title of the event is shared by both of its services
+			client := newTestRecollect(t, rawEventsHandler(`{"events": [
+				{"day": "2021-06-21", "title": "Holiday schedule", "flags": [
+					{"name": "Garbage", "service_name": "waste"}, {"name": "Recycling", "service_name": "waste"}
+				]},
+				{"day": "2021-06-28", "description": "Leaf collection - final pass", "flags": [
+					{"name": "Garbage", "service_name": "waste"}
+				]}
+			]}`))
+
+			var answer scheduleAnswer
+			var err error
+			if test.serviceType == "" {
+				answer, err = handleWhatIsNext(context.Background(), client, "1260 NW Maynard Rd")
+			} else {
+				answer, err = handleGetSchedule(context.Background(), client, "1260 NW Maynard Rd", test.serviceType)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.CardBody != test.expected {
+				t.Errorf("expected the card %q, got %q", test.expected, answer.CardBody)
+			}
+		})
+	}
+}
+
+func TestServiceWeekday(t *testing.T) {
+	tests := []struct {
+		name     string
+		days     []string
+		expected string
+	}{
+		{"consistent weekday", []string{"2021-06-21", "2021-06-28", "2021-07-05"}, "Your garbage is on Mondays."},
+		{"varying weekday", []string{"2021-06-24", "2021-06-28", "2021-07-05"}, "Your garbage varies; the next is Thursday June 24."},
+		{"single day this week", []string{"2021-06-25"}, "Your garbage is only scheduled on Friday in the next 30 days."},
+		{"single day later", []string{"2021-07-05"}, "Your garbage is only scheduled on Monday, July 5 in the next 30 days."},
+		{"single day tomorrow", []string{"2021-06-21"}, "Your garbage is only scheduled tomorrow in the next 30 days."},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			var occurrences []serviceOccurrence
+			for _, day := range test.days {
+				occurrences = append(occurrences, serviceOccurrence{day: day, name: "Garbage"})
+			}
+			client := newTestRecollect(t, eventsHandler(occurrences...))
+
+			answer, err := handleServiceWeekday(context.Background(), client, "1260 NW Maynard Rd", "garbage")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestRoutineSummaryEndsSession(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(
+		serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+		serviceOccurrence{day: "2021-06-21", name: "Recycling"},
+		serviceOccurrence{day: "2021-06-24", name: "yardwaste"},
+	))
+
+	response, err := intentDispatcher(context.Background(), client, newIntentRequest("RoutineSummary", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body := response.(alexa.Response).Body
+	if body.OutputSpeech.Text != "Tomorrow is garbage and recycling." {
+		t.Errorf("expected the one line summary, got %q", body.OutputSpeech.Text)
+	}
+	if !body.ShouldEndSession || body.Reprompt != nil {
+		t.Error("expected the session to end without a reprompt")
+	}
+}
+
+func TestResolveServiceTypeSubstringNames(t *testing.T) {
+	// Yard Waste is a substring of Yard Waste Bulk
+	occurrences := []serviceOccurrence{
+		{day: "2021-06-21", name: "Yard Waste Bulk"},
+		{day: "2021-06-24", name: "yardwaste"},
+	}
+	tests := []struct {
+		serviceType   string
+		serviceName   string
+		clarification string
+	}{
+		{"yard waste", "Yard Waste", ""},
+		{" Yard Waste ", "Yard Waste", ""},
+		{"yard waste bulk", "Yard Waste Bulk", ""},
+		{"yard", "", "Did you mean yard waste or yard waste bulk?"},
+	}
+
+	for _, test := range tests {
+		serviceName, clarification, ok := resolveServiceType("GetSchedule", test.serviceType, occurrences)
+		if serviceName != test.serviceName || ok != (test.clarification != "") || clarification.Speech != test.clarification {
+			t.Errorf(
+				"resolveServiceType(%q) = %q with the clarification %q, expected %q with the clarification %q",
+				test.serviceType, serviceName, clarification.Speech, test.serviceName, test.clarification,
+			)
+		}
+	}
+}
+
+func TestScheduleBetweenMultipleServiceIDs(t *testing.T) {
+	setenv(t, "RECOLLECT_SERVICE_IDS", "1087,2000")
+	handlers := map[string]http.HandlerFunc{
+		"/api/places/ABC123/services/1087/events": eventsHandler(
+			serviceOccurrence{day: "2021-06-28", name: "Garbage"}, serviceOccurrence{day: "2021-06-21", name: "Recycling"},
+		),
+		// The county also reports the recycling
+		"/api/places/ABC123/services/2000/events": eventsHandler(
+			serviceOccurrence{day: "2021-06-21", name: "Recycling"}, serviceOccurrence{day: "2021-06-24", name: "yardwaste"},
+		),
+	}
+	client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/areas/CaryNC/services/1087/address-suggest" {
+			w.Write([]byte(`[{"place_id": "ABC123"}]`))
+			return
+		}
+		handler, ok := handlers[r.URL.Path]
+		if !ok {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		handler(w, r)
+	})
+
+	after := time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)
+	occurrences, err := scheduleBetween(context.Background(), client, "1260 NW Maynard Rd", after, after.AddDate(0, 0, 30))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []serviceOccurrence{
+		{day: "2021-06-21", name: "Recycling"},
+		{day: "2021-06-24", name: "yardwaste"},
+		{day: "2021-06-28", name: "Garbage"},
+	}
+	if !reflect.DeepEqual(occurrences, expected) {
+		t.Errorf("expected the merged occurrences %+v, got %+v", expected, occurrences)
+	}
+}
+
+func TestLookaheadWindowMonthEnds(t *testing.T) {
+	tests := []struct {
+		name          string
+		now           time.Time
+		lookaheadDays string
+		before        string
+	}{
+		// Adding a month to January 31 would overflow to March 3
+		{"January 31", time.Date(2021, 1, 31, 17, 0, 0, 0, time.UTC), "30", "2021-03-02"},
+		{"January 31 for a month of days", time.Date(2021, 1, 31, 17, 0, 0, 0, time.UTC), "28", "2021-02-28"},
+		{"31st to a short month", time.Date(2021, 3, 31, 16, 0, 0, 0, time.UTC), "30", "2021-04-30"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "LOOKAHEAD_DAYS", test.lookaheadDays)
+			setNow(t, test.now)
+
+			after, before := getLookaheadWindow()
+			if day := before.Format("2006-01-02"); day != test.before {
+				t.Errorf("expected the window to end on %s, got %s", test.before, day)
+			}
+			days, _ := strconv.Atoi(test.lookaheadDays)
+			if length := before.Sub(after); length != time.Duration(days)*24*time.Hour {
+				t.Errorf("expected the window to be exactly %d days, got %v", days, length)
+			}
+		})
+	}
+}
+
+func TestWhatIsNextSkipsEmptyServiceNames(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, rawEventsHandler(`{"events": [
+		{"day": "2021-06-21", "flags": [{"name": " ", "service_name": "waste"}]},
+		{"day": "2021-06-22", "flags": [{"name": "Garbage", "service_name": "waste"}]}
+	]}`))
+
+	answer, err := handleWhatIsNext(context.Background(), client, "1260 NW Maynard Rd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The occurrence without a service name is bad data, so the next pick up is after it
+	expected := "In 2 days, on Tuesday, June 22, 2021, there will be curb side pick up for: garbage."
+	if answer.Speech != expected {
+		t.Errorf("expected %q, got %q", expected, answer.Speech)
+	}
+}
+
+func TestGetServiceTypeSlotID(t *testing.T) {
+	setenv(t, "SLOT_ID_SERVICES", "GARBAGE=Garbage, LEAVES=looseleaf")
+
+	tests := []struct {
+		name     string
+		slotJSON string
+		expected string
+	}{
+		{
+			"mapped ID",
+			`{"name": "collectionType", "value": "trash", "resolutions": {"resolutionsPerAuthority": [
+				{"values": [{"value": {"name": "garbage", "id": "GARBAGE"}}]}
+			]}}`,
+			"Garbage",
+		},
+		{
+			"mapped ID on a later authority",
+			`{"name": "collectionType", "value": "leaves", "resolutions": {"resolutionsPerAuthority": [
+				{"values": []},
+				{"values": [{"value": {"name": "leaves", "id": "LEAVES"}}]}
+			]}}`,
+			"looseleaf",
+		},
+		{
+			"unmapped ID falls back to the spoken value",
+			`{"name": "collectionType", "value": "the recycling", "resolutions": {"resolutionsPerAuthority": [
+				{"values": [{"value": {"name": "recycling", "id": "RECYCLING"}}]}
+			]}}`,
+			"recycling",
+		},
+		{"no resolutions", `{"name": "collectionType", "value": "garbage"}`, "garbage"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var slot alexa.Slot
+			if err := json.Unmarshal([]byte(test.slotJSON), &slot); err != nil {
+				t.Fatalf("failed to unmarshal the slot: %v", err)
+			}
+			intent := alexa.Intent{Name: "GetSchedule", Slots: map[string]alexa.Slot{"collectionType": slot}}
+
+			if serviceType := getServiceType(intent); serviceType != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, serviceType)
+			}
+		})
+	}
+}
+
+func TestAddSpeechPrefix(t *testing.T) {
+	plain := newAnswer("Garbage Curbside Pick Up", "Tomorrow is garbage.")
+	ssml := newAnswer("Garbage Curbside Pick Up", "Tomorrow is garbage.")
+	ssml.SSML = "Tomorrow is <emphasis>garbage</emphasis>."
+
+	tests := []struct {
+		name         string
+		answer       scheduleAnswer
+		prefix       string
+		expectedText string
+		expectedSSML string
+		expectedCard string
+		expectedType string
+	}{
+		{"plain text without a prefix", plain, "", "Tomorrow is garbage.", "", "Tomorrow is garbage.", "PlainText"},
+		{"plain text with a blank prefix", plain, "  ", "Tomorrow is garbage.", "", "Tomorrow is garbage.", "PlainText"},
+		{
+			"plain text with a prefix", plain, "Cary Curbside says:",
+			"Cary Curbside says: Tomorrow is garbage.", "", "Tomorrow is garbage.", "PlainText",
+		},
+		{
+			"SSML without a prefix", ssml, "",
+			"", "<speak>Tomorrow is <emphasis>garbage</emphasis>.</speak>", "Tomorrow is garbage.", "SSML",
+		},
+		{
+			"SSML with an escaped prefix", ssml, "Town & Country says:",
+			"", "<speak>Town &amp; Country says: Tomorrow is <emphasis>garbage</emphasis>.</speak>",
+			"Tomorrow is garbage.", "SSML",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := addSpeechPrefix(test.answer.toAlexaResponse(), test.prefix)
+
+			speech := response.Body.OutputSpeech
+			if speech.Type != test.expectedType || speech.Text != test.expectedText || speech.SSML != test.expectedSSML {
+				t.Errorf("unexpected output speech: %+v", speech)
+			}
+			// The prefix is only spoken and never shown on the card
+			if response.Body.Card.Content != test.expectedCard {
+				t.Errorf("expected the card %q, got %q", test.expectedCard, response.Body.Card.Content)
+			}
+		})
+	}
+}
+
+func TestUnparseableDay(t *testing.T) {
+	occurrence := serviceOccurrence{day: "06/21/2021", name: "Garbage"}
+
+	formatters := map[string]func() string{
+		"GetFormattedDay": occurrence.GetFormattedDay,
+		"GetCardDay":      occurrence.GetCardDay,
+		"GetListDay":      occurrence.GetListDay,
+		"GetMonthDay":     occurrence.GetMonthDay,
+		"relativeDayPhrase": func() string {
+			return relativeDayPhrase(occurrence.day)
+		},
+	}
+	for name, formatter := range formatters {
+		if day := formatter(); day != unknownDayPhrase {
+			t.Errorf("expected %s to return %q, got %q", name, unknownDayPhrase, day)
+		}
+	}
+
+	// The other days are still listed around the unparseable day
+	expected := []string{"June 21", unknownDayPhrase, "June 23"}
+	if phrases := collapseDayRanges([]string{"2021-06-21", "bad day", "2021-06-23"}); !reflect.DeepEqual(phrases, expected) {
+		t.Errorf("expected %v, got %v", expected, phrases)
+	}
+}
+
+func TestGetScheduleUnparseableDay(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, rawEventsHandler(`{"events": [
+		{"day": "June 21", "flags": [{"name": "Garbage", "service_name": "waste"}]}
+	]}`))
+
+	answer, err := handleGetSchedule(context.Background(), client, "1260 NW Maynard Rd", "garbage")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The occurrence still counts as present but its day is never spoken as a wrong date
+	expected := "Curbside pick up for garbage is on an unspecified upcoming day, and possibly more after that."
+	if answer.Speech != expected {
+		t.Errorf("expected %q, got %q", expected, answer.Speech)
+	}
+}
+
+func TestNextMonth(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+
+	var eventsQuery url.Values
+	handler := eventsHandler(
+		serviceOccurrence{day: "2021-06-28", name: "Garbage"},
+		serviceOccurrence{day: "2021-07-05", name: "Garbage"},
+		serviceOccurrence{day: "2021-07-12", name: "Garbage"},
+		serviceOccurrence{day: "2021-07-12", name: "Recycling"},
+		serviceOccurrence{day: "2021-07-19", name: "Garbage"},
+		serviceOccurrence{day: "2021-07-26", name: "Garbage"},
+		serviceOccurrence{day: "2021-07-26", name: "Recycling"},
+		serviceOccurrence{day: "2021-08-02", name: "Garbage"},
+	)
+	client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/events") {
+			eventsQuery = r.URL.Query()
+		}
+		handler(w, r)
+	})
+
+	answer, err := handleNextMonth(context.Background(), client, "1260 NW Maynard Rd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The query covers next month even though it's past the look ahead window
+	if eventsQuery.Get("after") != "2021-07-01" || eventsQuery.Get("before") != "2021-08-01" {
+		t.Errorf("expected the events from 2021-07-01 to 2021-08-01, got %v", eventsQuery)
+	}
+	// The pick ups outside of July that recollect returned are left out
+	expected := "In July, there will be curbside pick up on 4 days. Garbage is picked up 4 times: on July 5, July 12, " +
+		"July 19, and July 26. Recycling is picked up twice: on July 12 and July 26."
+	if answer.Speech != expected {
+		t.Errorf("expected %q, got %q", expected, answer.Speech)
+	}
+	expectedCard := "Monday, July 5, 2021: garbage\nMonday, July 12, 2021: garbage and recycling\n" +
+		"Monday, July 19, 2021: garbage\nMonday, July 26, 2021: garbage and recycling"
+	if answer.CardTitle != "July Curbside Pick Up" || answer.CardBody != expectedCard {
+		t.Errorf("unexpected card %q: %q", answer.CardTitle, answer.CardBody)
+	}
+}
+
+func TestNextMonthNoPickUps(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setNow(t, time.Date(2021, 12, 20, 17, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: "2021-12-27", name: "Garbage"}))
+
+	answer, err := handleNextMonth(context.Background(), client, "1260 NW Maynard Rd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Next month is in the next year
+	if expected := "No curbside pick up is scheduled in January."; answer.Speech != expected {
+		t.Errorf("expected %q, got %q", expected, answer.Speech)
+	}
+}
+
+func TestCollapseDayRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		days     []string
+		expected []string
+	}{
+		{"three day run", []string{"2021-06-21", "2021-06-22", "2021-06-23"}, []string{"June 21 through June 23"}},
+		{"two day run", []string{"2021-06-21", "2021-06-22"}, []string{"June 21", "June 22"}},
+		{
+			"run across months and a separate day", []string{"2021-06-29", "2021-06-30", "2021-07-01", "2021-07-05"},
+			[]string{"June 29 through July 1", "July 5"},
+		},
+		{"no run", []string{"2021-06-21", "2021-06-28"}, []string{"June 21", "June 28"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if phrases := collapseDayRanges(test.days); !reflect.DeepEqual(phrases, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, phrases)
+			}
+		})
+	}
+}
+
+func TestNextMonthConsecutiveDays(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setNow(t, time.Date(2021, 9, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(
+		serviceOccurrence{day: "2021-10-11", name: "looseleaf"},
+		serviceOccurrence{day: "2021-10-12", name: "looseleaf"},
+		serviceOccurrence{day: "2021-10-13", name: "looseleaf"},
+		serviceOccurrence{day: "2021-10-18", name: "yardwaste"},
+		serviceOccurrence{day: "2021-10-19", name: "yardwaste"},
+	))
+
+	answer, err := handleNextMonth(context.Background(), client, "1260 NW Maynard Rd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "In October, there will be curbside pick up on 5 days. Leaf collection runs October 11 through " +
+		"October 13. Yard waste is picked up twice: on October 18 and October 19."
+	if answer.Speech != expected {
+		t.Errorf("expected %q, got %q", expected, answer.Speech)
+	}
+}
+
+func TestFlagsWithoutServiceNames(t *testing.T) {
+	eventsJSON := `{"events": [
+		{"day": "2021-06-21", "flags": [{"name": "Garbage"}, {"name": "Holiday"}]},
+		{"day": "2021-06-22", "flags": [{"name": "recycling"}]},
+		{"day": "2021-06-23", "flags": [{"name": "Organics"}]}
+	]}`
+
+	tests := []struct {
+		name         string
+		serviceNames string
+		expected     []serviceOccurrence
+	}{
+		{
+			"default service names", "",
+			[]serviceOccurrence{{day: "2021-06-21", name: "Garbage"}, {day: "2021-06-22", name: "recycling"}},
+		},
+		{
+			"configured service names", "Garbage,Organics",
+			[]serviceOccurrence{{day: "2021-06-21", name: "Garbage"}, {day: "2021-06-23", name: "Organics"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "SERVICE_NAMES", test.serviceNames)
+			client := newTestRecollect(t, rawEventsHandler(eventsJSON))
+
+			after := time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)
+			occurrences, err := scheduleBetween(context.Background(), client, "1260 NW Maynard Rd", after, after.AddDate(0, 0, 30))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Only the flags with known service names are pick ups since none have a service name
+			if !reflect.DeepEqual(occurrences, test.expected) {
+				t.Errorf("expected the occurrences %+v, got %+v", test.expected, occurrences)
+			}
+		})
+	}
+}
+
+func TestFrequency(t *testing.T) {
+	tests := []struct {
+		name        string
+		serviceType string
+		expected    string
+	}{
+		{"weekly", "garbage", "Garbage is picked up weekly."},
+		{"biweekly", "recycling", "Recycling is picked up every two weeks."},
+		{"single occurrence", "leaf collection", "Leaf Collection appears once in the next 30 days."},
+		{"irregular", "yard waste", "Yard Waste is picked up 3 times in the next 30 days, but not on a regular schedule."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+				serviceOccurrence{day: "2021-06-21", name: "Recycling"},
+				serviceOccurrence{day: "2021-06-22", name: "yardwaste"},
+				serviceOccurrence{day: "2021-06-24", name: "looseleaf"},
+				serviceOccurrence{day: "2021-06-28", name: "Garbage"},
+				serviceOccurrence{day: "2021-06-29", name: "yardwaste"},
+				serviceOccurrence{day: "2021-07-05", name: "Garbage"},
+				serviceOccurrence{day: "2021-07-05", name: "Recycling"},
+				serviceOccurrence{day: "2021-07-09", name: "yardwaste"},
+				serviceOccurrence{day: "2021-07-12", name: "Garbage"},
+				serviceOccurrence{day: "2021-07-19", name: "Garbage"},
+				serviceOccurrence{day: "2021-07-19", name: "Recycling"},
+			))
+
+			answer, err := handleFrequency(context.Background(), client, "1260 NW Maynard Rd", test.serviceType)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestGetScheduleOutOfSeason(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "SEASONAL_SERVICES", "looseleaf=10-1")
+
+	t.Run("out of season", func(t *testing.T) {
+		setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+		client := doerFunc(func(req *http.Request) (*http.Response, error) {
+			t.Errorf("unexpected request to %s", req.URL)
+			return nil, errors.New("unexpected request")
+		})
+
+		answer, err := handleGetSchedule(context.Background(), client, "1260 NW Maynard Rd", "leaf collection")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := "Leaf Collection runs only from October through January."; answer.Speech != expected {
+			t.Errorf("expected %q, got %q", expected, answer.Speech)
+		}
+	})
+
+	t.Run("in season across the new year", func(t *testing.T) {
+		setNow(t, time.Date(2022, 1, 10, 17, 0, 0, 0, time.UTC))
+		client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: "2022-01-11", name: "looseleaf"}))
+
+		answer, err := handleGetSchedule(context.Background(), client, "1260 NW Maynard Rd", "leaf collection")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.Contains(answer.Speech, "Tuesday, January 11, 2022") {
+			t.Errorf("expected the scheduled leaf collection, got %q", answer.Speech)
+		}
+	})
+}
+
+func TestDispatchIntentNameVariants(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: "2021-06-21", name: "Garbage"}))
+
+	slots := map[string]string{"collectionType": "garbage"}
+	expected, err := dispatchIntent(context.Background(), client, newIntentRequest("GetSchedule", slots))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(expected.Speech, "garbage") {
+		t.Fatalf("expected the garbage schedule, got %q", expected.Speech)
+	}
+
+	for _, intentName := range []string{"getschedule", "GETSCHEDULE", " GetSchedule ", "Cary.getSchedule"} {
+		t.Run(intentName, func(t *testing.T) {
+			answer, err := dispatchIntent(context.Background(), client, newIntentRequest(intentName, slots))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != expected.Speech {
+				t.Errorf("expected the GetSchedule answer %q, got %q", expected.Speech, answer.Speech)
+			}
+		})
+	}
+
+	// The AMAZON namespace is kept so that it's never stripped to a custom intent
+	for _, test := range []struct{ intentName, expected string }{
+		{"amazon.helpintent", "AMAZON.HelpIntent"},
+		{"AMAZON.GetSchedule", "AMAZON.GetSchedule"},
+	} {
+		if intentName := normalizeIntentName(test.intentName); intentName != test.expected {
+			t.Errorf("expected %s to be normalized to %s, got %s", test.intentName, test.expected, intentName)
+		}
+	}
+}
+
+func TestCompactCardDates(t *testing.T) {
+	tests := []struct {
+		name             string
+		compactCardDates string
+		expectedCard     string
+	}{
+		{"verbose", "", "Curbside pick up for garbage is on Monday, June 28, 2021."},
+		{"compact", "true", "Curbside pick up for garbage is on Mon 6/28."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "COMPACT_CARD_DATES", test.compactCardDates)
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: "2021-06-28", name: "Garbage"}))
+
+			answer, err := handleGetSchedule(context.Background(), client, "1260 NW Maynard Rd", "garbage")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The speech is always verbose
+			if expected := "Curbside pick up for garbage is on Monday, June 28, 2021."; answer.Speech != expected {
+				t.Errorf("expected the speech %q, got %q", expected, answer.Speech)
+			}
+			if answer.CardBody != test.expectedCard {
+				t.Errorf("expected the card %q, got %q", test.expectedCard, answer.CardBody)
+			}
+		})
+	}
+}
+
+func TestCombinedDatePhrasing(t *testing.T) {
+	tests := []struct {
+		name     string
+		day      string
+		phrasing string
+		expected string
+	}{
+		{"today", "2021-06-20", "combined", "Curbside pick up for garbage is today, Sunday, June 20, 2021."},
+		{"tomorrow", "2021-06-21", "combined", "Curbside pick up for garbage is tomorrow, Monday, June 21, 2021."},
+		{"distant date", "2021-07-05", "combined", "Curbside pick up for garbage is on Monday, July 5, 2021."},
+		{"tomorrow without combined phrasing", "2021-06-21", "", "Curbside pick up for garbage is on Monday, June 21, 2021."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "DATE_PHRASING", test.phrasing)
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: test.day, name: "Garbage"}))
+
+			answer, err := handleGetSchedule(context.Background(), client, "1260 NW Maynard Rd", "garbage")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestOrphanedConversationalIntents(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request to %s", req.URL)
+		return nil, errors.New("unexpected request")
+	})
+
+	const expected = "I'm not sure what you're responding to. You can say things like what's next or when's recycling."
+	intentNames := []string{
+		"AMAZON.YesIntent", "AMAZON.NoIntent", "AMAZON.RepeatIntent", "AMAZON.MoreIntent", "AMAZON.NextIntent",
+	}
+	for _, intentName := range intentNames {
+		t.Run(intentName, func(t *testing.T) {
+			// A pending clarification question isn't answered by yes or no either
+			for _, attributes := range []map[string]interface{}{nil, {"pendingIntent": "Frequency"}} {
+				request := newIntentRequest(intentName, nil)
+				request.Session.Attributes = attributes
+
+				response, err := intentDispatcher(context.Background(), client, request)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				body := response.(alexa.Response).Body
+				if body.OutputSpeech.Text != expected {
+					t.Errorf("expected %q with the session attributes %v, got %q", expected, attributes, body.OutputSpeech.Text)
+				}
+				if body.ShouldEndSession || body.Reprompt == nil {
+					t.Error("expected the session to stay open with a reprompt")
+				}
+			}
+		})
+	}
+}
+
+func TestGetScheduleNearWindowEnd(t *testing.T) {
+	tests := []struct {
+		name     string
+		day      string
+		hintDays string
+		expected string
+	}{
+		{
+			"last day of the window", "2021-07-20", "",
+			"Curbside pick up for leaf collection is on Tuesday, July 20, 2021, and possibly more after that.",
+		},
+		{
+			"before the hint days", "2021-07-17", "",
+			"Curbside pick up for leaf collection is on Saturday, July 17, 2021.",
+		},
+		{
+			"within the configured hint days", "2021-07-17", "5",
+			"Curbside pick up for leaf collection is on Saturday, July 17, 2021, and possibly more after that.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "LOOKAHEAD_DAYS", "30")
+			setenv(t, "WINDOW_END_HINT_DAYS", test.hintDays)
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: test.day, name: "looseleaf"}))
+
+			answer, err := handleGetSchedule(context.Background(), client, "1260 NW Maynard Rd", "leaf collection")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestRelativeDayPhraseNextWeekday(t *testing.T) {
+	tests := []struct {
+		name     string
+		style    string
+		day      string
+		expected string
+	}{
+		{"7 days", "next-weekday", "2021-06-27", "next Sunday"},
+		{"10 days", "next-weekday", "2021-06-30", "next Wednesday"},
+		{"14 days", "next-weekday", "2021-07-04", "Sunday, July 4"},
+		{"6 days", "next-weekday", "2021-06-26", "Saturday"},
+		{"7 days without the style", "", "2021-06-27", "Sunday, June 27"},
+		{"10 days without the style", "", "2021-06-30", "Wednesday, June 30"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "PHRASING_STYLE", test.style)
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+
+			if actual := relativeDayPhrase(test.day); actual != test.expected {
+				t.Errorf("relativeDayPhrase(%q) = %q, expected %q", test.day, actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestWhatIsNextNotices(t *testing.T) {
+	eventsJSON := `{"events": [
+		{"day": "2021-06-21", "flags": [
+			{"name": "Garbage", "service_name": "waste"}, {"name": "Street Sweeping", "service_name": "sweeping"}
+		]},
+		{"day": "2021-06-24", "title": "Park Day", "flags": [{"name": "Community Cleanup", "service_name": "event"}]},
+		{"day": "2021-06-28", "flags": [{"name": "Recycling", "service_name": "waste"}]},
+		{"day": "2021-07-05", "flags": [{"name": "Street Sweeping", "service_name": "sweeping"}]}
+	]}`
+	const pickUpCard = "On Monday, June 21, 2021, there will be curb side pick up for: garbage."
+
+	tests := []struct {
+		name         string
+		showNotices  string
+		expectedCard string
+	}{
+		{"notices disabled", "", pickUpCard},
+		{
+			"notices enabled", "true",
+			pickUpCard + "\n\nAlso this week:\nMonday, June 21, 2021: Street Sweeping\n" +
+				"Thursday, June 24, 2021: Community Cleanup (Park Day)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "SHOW_NOTICES", test.showNotices)
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, rawEventsHandler(eventsJSON))
+
+			answer, err := handleWhatIsNext(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The notices are never spoken as pick ups
+			if expected := "Tomorrow, on Monday, June 21, 2021, there will be curb side pick up for: garbage."; answer.Speech != expected {
+				t.Errorf("expected the speech %q, got %q", expected, answer.Speech)
+			}
+			if answer.CardBody != test.expectedCard {
+				t.Errorf("expected the card %q, got %q", test.expectedCard, answer.CardBody)
+			}
+		})
+	}
+}
+
+func TestWhatIsNextSameAsUsual(t *testing.T) {
+	tests := []struct {
+		name         string
+		nextPickUp   string
+		expected     string
+		expectedCard string
+	}{
+		{
+			"normal week", "2021-06-21", "Same as usual, garbage and recycling on Monday.",
+			"Same as usual, garbage and recycling on Monday.\n" +
+				"On Monday, June 21, 2021, there will be curb side pick up for: garbage and recycling.",
+		},
+		{
+			"shifted week", "2021-06-22",
+			"In 2 days, on Tuesday, June 22, 2021, there will be curb side pick up for: garbage and recycling.",
+			"On Tuesday, June 22, 2021, there will be curb side pick up for: garbage and recycling.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "SAME_AS_USUAL", "true")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: test.nextPickUp, name: "Garbage"},
+				serviceOccurrence{day: test.nextPickUp, name: "Recycling"},
+				serviceOccurrence{day: "2021-06-28", name: "Garbage"},
+				serviceOccurrence{day: "2021-07-05", name: "Garbage"},
+				serviceOccurrence{day: "2021-07-05", name: "Recycling"},
+				serviceOccurrence{day: "2021-07-12", name: "Garbage"},
+				serviceOccurrence{day: "2021-07-19", name: "Garbage"},
+				serviceOccurrence{day: "2021-07-19", name: "Recycling"},
+			))
+
+			answer, err := handleWhatIsNext(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+			if answer.CardBody != test.expectedCard {
+				t.Errorf("expected the card %q, got %q", test.expectedCard, answer.CardBody)
+			}
+		})
+	}
+}
+
+func TestGetScheduleLeadingArticles(t *testing.T) {
+	tests := []struct {
+		slotValue string
+		expected  string
+	}{
+		{"the garbage", "Curbside pick up for garbage is on Monday, June 21, 2021."},
+		{"my recycling", "Curbside pick up for recycling is on Tuesday, June 22, 2021."},
+		{"a yard waste", "Curbside pick up for yard waste is on Wednesday, June 23, 2021."},
+		{"The Garbage", "Curbside pick up for garbage is on Monday, June 21, 2021."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.slotValue, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+				serviceOccurrence{day: "2021-06-22", name: "Recycling"},
+				serviceOccurrence{day: "2021-06-23", name: "yardwaste"},
+			))
+
+			request := newIntentRequest("GetSchedule", map[string]string{"collectionType": test.slotValue})
+			answer, err := dispatchIntent(context.Background(), client, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+
+	// A lone article isn't stripped to an empty service type
+	if serviceType := normalizeServiceType("the"); serviceType != "the" {
+		t.Errorf("expected the service type the, got %q", serviceType)
+	}
+}
+
+func TestNextTwoDays(t *testing.T) {
+	tests := []struct {
+		name        string
+		occurrences []serviceOccurrence
+		expected    string
+	}{
+		{
+			"two days",
+			[]serviceOccurrence{
+				{day: "2021-06-21", name: "Recycling"},
+				{day: "2021-06-21", name: "Garbage"},
+				{day: "2021-06-24", name: "yardwaste"},
+				{day: "2021-06-28", name: "Garbage"},
+			},
+			"Tomorrow: garbage and recycling. Thursday: yard waste.",
+		},
+		{
+			"single day",
+			[]serviceOccurrence{{day: "2021-06-24", name: "looseleaf"}},
+			"Thursday: leaf collection. There are no other pick ups in the next 30 days.",
+		},
+		{"no days", nil, "No curbside pick up is scheduled in the next 30 days."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(test.occurrences...))
+
+			answer, err := handleNextTwoDays(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestWhatIsNextFullDay(t *testing.T) {
+	allServices := []serviceOccurrence{
+		{day: "2021-06-21", name: "Garbage"},
+		{day: "2021-06-21", name: "Recycling"},
+		{day: "2021-06-21", name: "yardwaste"},
+		{day: "2021-06-21", name: "looseleaf"},
+	}
+
+	tests := []struct {
+		name         string
+		occurrences  []serviceOccurrence
+		fullDayMsg   string
+		expected     string
+		expectedCard string
+	}{
+		{
+			"all services", allServices, "",
+			"Monday, June 21, 2021 is a full pick up day with all services.",
+			"Monday, June 21, 2021 is a full pick up day with all services.",
+		},
+		{
+			"all services with a custom message", allServices, "Everything goes out on {day}!",
+			"Everything goes out on Monday, June 21, 2021!", "Everything goes out on Monday, June 21, 2021!",
+		},
+		{
+			"subset of the services", allServices[:3], "",
+			"Tomorrow, on Monday, June 21, 2021, there will be curb side pick up for: garbage, recycling, and yardwaste.",
+			"On Monday, June 21, 2021, there will be curb side pick up for: garbage, recycling, and yardwaste.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "FULL_DAY_MESSAGE", test.fullDayMsg)
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(test.occurrences...))
+
+			answer, err := handleWhatIsNext(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+			if answer.CardBody != test.expectedCard {
+				t.Errorf("expected the card %q, got %q", test.expectedCard, answer.CardBody)
+			}
+		})
+	}
+}
+
+func TestFullStreetAddress(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd, Cary, NC 27513")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+
+	var suggestQuery string
+	handler := eventsHandler(serviceOccurrence{day: "2021-06-21", name: "Garbage"})
+	client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/address-suggest") {
+			suggestQuery = r.URL.Query().Get("q")
+		}
+		handler(w, r)
+	})
+
+	answer, err := dispatchIntent(context.Background(), client, newIntentRequest("WhatIsNext", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if suggestQuery != "1260 NW Maynard Rd" {
+		t.Errorf("expected the address suggestions for the street line, got %q", suggestQuery)
+	}
+	if !strings.Contains(answer.Speech, "garbage") {
+		t.Errorf("expected the garbage pick up, got %q", answer.Speech)
+	}
+}
+
+func TestGetStreetLine(t *testing.T) {
+	tests := []struct {
+		address  string
+		city     string
+		expected string
+	}{
+		{"1260 NW Maynard Rd, Cary, NC 27513", "", "1260 NW Maynard Rd"},
+		{"1260 NW Maynard Rd, cary nc", "", "1260 NW Maynard Rd"},
+		{"1260 NW Maynard Rd", "", "1260 NW Maynard Rd"},
+		{"100 Cary Pkwy, Cary, NC", "", "100 Cary Pkwy"},
+		{"73 Hunter St, Apex, NC 27502", "Apex", "73 Hunter St"},
+		{"73 Hunter St, Apex, NC 27502", "", "73 Hunter St, Apex, NC 27502"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			setenv(t, "ADDRESS_CITY", test.city)
+			if streetLine := getStreetLine(test.address); streetLine != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, streetLine)
+			}
+		})
+	}
+}
+
+func TestSpeechAndCardDateFormats(t *testing.T) {
+	tests := []struct {
+		name             string
+		speechFormat     string
+		cardFormat       string
+		compactCardDates string
+		expectedSpeech   string
+		expectedCard     string
+	}{
+		{"defaults", "", "", "", "Monday, June 21, 2021", "Monday, June 21, 2021"},
+		{"verbose speech and compact card", "full", "compact", "", "Monday, June 21, 2021", "Mon 6/21"},
+		{"compact speech and verbose card", "compact", "full", "", "Mon 6/21", "Monday, June 21, 2021"},
+		{"card follows the speech format", "no-year", "", "", "Monday, June 21", "Monday, June 21"},
+		{"card without the year", "", "no-year", "", "Monday, June 21, 2021", "Monday, June 21"},
+		{"card format overrides compact card dates", "", "no-year", "true", "Monday, June 21, 2021", "Monday, June 21"},
+		{"unknown formats", "short", "tiny", "", "Monday, June 21, 2021", "Monday, June 21, 2021"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "SPEECH_DATE_FORMAT", test.speechFormat)
+			setenv(t, "CARD_DATE_FORMAT", test.cardFormat)
+			setenv(t, "COMPACT_CARD_DATES", test.compactCardDates)
+
+			occurrence := serviceOccurrence{day: "2021-06-21", name: "Garbage"}
+			if day := occurrence.GetFormattedDay(); day != test.expectedSpeech {
+				t.Errorf("expected the speech day %q, got %q", test.expectedSpeech, day)
+			}
+			if day := occurrence.GetCardDay(); day != test.expectedCard {
+				t.Errorf("expected the card day %q, got %q", test.expectedCard, day)
+			}
+		})
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		eventsJSON string
+		expected   string
+	}{
+		{
+			"latest day is a notice",
+			`{"events": [
+				{"day": "2021-11-29", "flags": [{"name": "Garbage", "service_name": "waste"}]},
+				{"day": "2021-06-21", "flags": [{"name": "Recycling", "service_name": "waste"}]},
+				{"day": "2021-12-06", "flags": [{"name": "Street Sweeping", "service_name": "sweeping"}]}
+			]}`,
+			"Schedule data is available through December 6.",
+		},
+		{"no events", `{"events": []}`, "No schedule data is available."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+
+			var eventsQuery url.Values
+			handler := rawEventsHandler(test.eventsJSON)
+			client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/events") {
+					eventsQuery = r.URL.Query()
+				}
+				handler(w, r)
+			})
+
+			answer, err := handleDebugInfo(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// The query looks a year ahead to find the end of the schedule data
+			if eventsQuery.Get("after") != "2021-06-20" || eventsQuery.Get("before") != "2022-06-20" {
+				t.Errorf("expected the events from 2021-06-20 to 2022-06-20, got %v", eventsQuery)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestIntentDispatcherNilContext(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: "2021-06-21", name: "Garbage"}))
+
+	// Alternate invokers may not provide a context
+	var ctx context.Context
+	response, err := intentDispatcher(ctx, client, newIntentRequest("WhatIsNext", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A nil context would panic when building the recollect requests, which is
+	// recovered from with an error message
+	card := response.(alexa.Response).Body.Card
+	expected := "On Monday, June 21, 2021, there will be curb side pick up for: garbage."
+	if card.Title != "Curbside Pick Up Schedule" || card.Content != expected {
+		t.Errorf("expected the schedule card %q, got %q: %q", expected, card.Title, card.Content)
+	}
+}
+
+func TestGetAddressIDChangedWarning(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	placeID := "ABC123"
+	client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"place_id": %q}]`, placeID)
+	})
+	start := time.Date(2021, 6, 21, 16, 0, 0, 0, time.UTC)
+	setNow(t, start)
+	if addressID, err := getAddressID(context.Background(), client, "1260 NW Maynard Rd"); err != nil || addressID != "ABC123" {
+		t.Fatalf("expected the address ID ABC123, got %q and the error %v", addressID, err)
+	}
+
+	// recollect re-indexed its addresses after the cached address ID expired
+	placeID = "DEF456"
+	setNow(t, start.Add(addressIDCacheTTL+time.Minute))
+	if addressID, err := getAddressID(context.Background(), client, "1260 NW Maynard Rd"); err != nil || addressID != "DEF456" {
+		t.Fatalf("expected the address ID DEF456, got %q and the error %v", addressID, err)
+	}
+
+	if !strings.Contains(logs.String(), "Warning: the address ID changed from ABC123 to DEF456") {
+		t.Errorf("expected the changed address ID warning in the logs:\n%s", logs.String())
+	}
+}
+
+func TestEventWithSeveralWasteFlags(t *testing.T) {
+	client := newTestRecollect(t, rawEventsHandler(`{"events": [
+		{"day": "2021-06-21", "flags": [
+			{"name": "Garbage", "service_name": "waste"},
+			{"name": "Recycling", "service_name": "waste"},
+			{"name": "garbage", "service_name": "waste"}
+		]}
+	]}`))
+
+	after := time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)
+	occurrences, err := scheduleBetween(context.Background(), client, "1260 NW Maynard Rd", after, after.AddDate(0, 0, 30))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Each distinct waste flag is a service, but a repeated flag isn't
+	expected := []serviceOccurrence{{day: "2021-06-21", name: "Garbage"}, {day: "2021-06-21", name: "Recycling"}}
+	if !reflect.DeepEqual(occurrences, expected) {
+		t.Errorf("expected the occurrences %+v, got %+v", expected, occurrences)
+	}
+}
+
+func TestSeasonInfo(t *testing.T) {
+	season := []serviceOccurrence{
+		{day: "2021-06-21", name: "Garbage"},
+		{day: "2021-10-25", name: "looseleaf"},
+		{day: "2021-11-08", name: "looseleaf"},
+		{day: "2021-12-06", name: "looseleaf"},
+		{day: "2022-01-10", name: "looseleaf"},
+	}
+
+	tests := []struct {
+		name        string
+		occurrences []serviceOccurrence
+		expected    string
+	}{
+		{"season", season, "Leaf Collection runs from October 25 to January 10."},
+		{"single day", season[:2], "I don't have season info for leaf collection."},
+		{"no days", season[:1], "I don't have season info for leaf collection."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(test.occurrences...))
+
+			answer, err := handleSeasonInfo(context.Background(), client, "1260 NW Maynard Rd", "leaf collection")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestServiceTypeAliases(t *testing.T) {
+	expectedSpeech := map[string]string{
+		"Garbage":         "Curbside pick up for garbage is on Monday, June 21, 2021.",
+		"Recycling":       "Curbside pick up for recycling is on Tuesday, June 22, 2021.",
+		"Yard Waste":      "Curbside pick up for yard waste is on Wednesday, June 23, 2021.",
+		"Leaf Collection": "Curbside pick up for leaf collection is on Thursday, June 24, 2021.",
+	}
+
+	for alias, serviceName := range serviceTypeAliases {
+		t.Run(alias, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+				serviceOccurrence{day: "2021-06-22", name: "Recycling"},
+				serviceOccurrence{day: "2021-06-23", name: "yardwaste"},
+				serviceOccurrence{day: "2021-06-24", name: "looseleaf"},
+			))
+
+			request := newIntentRequest("GetSchedule", map[string]string{"collectionType": alias})
+			answer, err := dispatchIntent(context.Background(), client, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected := expectedSpeech[serviceName]; answer.Speech != expected {
+				t.Errorf("expected %q, got %q", expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestUnknownServiceType(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: "2021-06-21", name: "Garbage"}))
+
+	request := newIntentRequest("GetSchedule", map[string]string{"collectionType": "compost"})
+	answer, err := dispatchIntent(context.Background(), client, request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "I don't recognize the collection type compost. Try garbage, recycling, yard waste, or leaf collection."
+	if answer.Speech != expected {
+		t.Errorf("expected %q, got %q", expected, answer.Speech)
+	}
+}
+
+func TestDateLikeServiceType(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request to %s", req.URL)
+		return nil, errors.New("unexpected request")
+	})
+
+	for _, slotValue := range []string{"2021-06-24", "XXXX-06-24", "2021-W25", "6/24", "24"} {
+		t.Run(slotValue, func(t *testing.T) {
+			request := newIntentRequest("GetSchedule", map[string]string{"collectionType": slotValue})
+			response, err := intentDispatcher(context.Background(), client, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			clarification := response.(alexa.Response)
+			expected := "Did you mean garbage, recycling, yard waste, or leaf collection?"
+			if clarification.Body.OutputSpeech.Text != expected {
+				t.Errorf("expected %q, got %q", expected, clarification.Body.OutputSpeech.Text)
+			}
+			if clarification.SessionAttributes["pendingIntent"] != "GetSchedule" {
+				t.Errorf("expected the pending GetSchedule intent, got %v", clarification.SessionAttributes)
+			}
+		})
+	}
+
+	if isDateLike("garbage") || isDateLike("yard waste") {
+		t.Error("expected the collection types to not be date-like")
+	}
+}
+
+func TestIntentFlags(t *testing.T) {
+	setenv(t, "TIME_ZONE", "America/New_York")
+	setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+	setenv(t, "INTENT_FLAGS", "DebugInfo=false, whatisnext=true, NextTwoDays=maybe")
+	setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+
+	requests := 0
+	handler := eventsHandler(serviceOccurrence{day: "2021-06-21", name: "Garbage"})
+	client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		handler(w, r)
+	})
+
+	answer, err := dispatchIntent(context.Background(), client, newIntentRequest("DebugInfo", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "That feature isn't enabled for this skill."; answer.Speech != expected {
+		t.Errorf("expected %q, got %q", expected, answer.Speech)
+	}
+	if requests != 0 {
+		t.Errorf("expected no recollect requests for the disabled intent, got %d", requests)
+	}
+
+	// An explicitly enabled intent, an invalid flag, and an unlisted intent all still work
+	tests := map[string]string{
+		"WhatIsNext":     "Tomorrow, on Monday, June 21, 2021, there will be curb side pick up for: garbage.",
+		"NextTwoDays":    "Tomorrow: garbage. There are no other pick ups in the next 30 days.",
+		"RoutineSummary": "Tomorrow is garbage.",
+	}
+	for intentName, expected := range tests {
+		answer, err := dispatchIntent(context.Background(), client, newIntentRequest(intentName, nil))
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", intentName, err)
+		}
+		if answer.Speech != expected {
+			t.Errorf("expected the %s answer %q, got %q", intentName, expected, answer.Speech)
+		}
+	}
+}
+
+func TestWeekAhead(t *testing.T) {
+	tests := []struct {
+		name       string
+		interfaces map[string]interface{}
+		expected   string
+	}{
+		{"no display", nil, "Tomorrow: garbage and recycling. Thursday: yard waste."},
+		{"audio only", map[string]interface{}{"AudioPlayer": map[string]interface{}{}}, "Tomorrow: garbage and recycling. Thursday: yard waste."},
+		{"display", map[string]interface{}{"Display": map[string]interface{}{}}, "Here's your week ahead with 2 pick up days."},
+		{"APL", map[string]interface{}{"Alexa.Presentation.APL": map[string]interface{}{}}, "Here's your week ahead with 2 pick up days."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-21", name: "Recycling"},
+				serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+				serviceOccurrence{day: "2021-06-24", name: "yardwaste"},
+				serviceOccurrence{day: "2021-06-28", name: "Garbage"},
+			))
+
+			request := newIntentRequest("WeekAhead", nil)
+			request.DeviceContext.System.Device.SupportedInterfaces = test.interfaces
+			answer, err := dispatchIntent(context.Background(), client, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+
+			// The card always has every day of the week
+			expectedCard := "Sun 6/20: -\nMon 6/21: garbage and recycling\nTue 6/22: -\nWed 6/23: -\n" +
+				"Thu 6/24: yard waste\nFri 6/25: -\nSat 6/26: -"
+			if answer.CardBody != expectedCard {
+				t.Errorf("expected the card %q, got %q", expectedCard, answer.CardBody)
+			}
+		})
+	}
+}
+
+func TestAttribution(t *testing.T) {
+	const scheduleCard = "Curbside pick up for garbage is on Monday, June 21, 2021."
+
+	tests := []struct {
+		name         string
+		attribution  string
+		intentName   string
+		expectedCard string
+	}{
+		{"enabled", "true", "GetSchedule", scheduleCard + "\n\nSchedule data from ReCollect."},
+		{"disabled", "false", "GetSchedule", scheduleCard},
+		{"unset", "", "GetSchedule", scheduleCard},
+		{"enabled without schedule data", "true", "AMAZON.StopIntent", "Goodbye."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+			setenv(t, "ATTRIBUTION", test.attribution)
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(serviceOccurrence{day: "2021-06-21", name: "Garbage"}))
+
+			request := newIntentRequest(test.intentName, map[string]string{"collectionType": "garbage"})
+			response, err := intentDispatcher(context.Background(), client, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			body := response.(alexa.Response).Body
+			if body.Card.Content != test.expectedCard {
+				t.Errorf("expected the card %q, got %q", test.expectedCard, body.Card.Content)
+			}
+			// The attribution is never spoken
+			if strings.Contains(body.OutputSpeech.Text+body.OutputSpeech.SSML, "ReCollect") {
+				t.Errorf("expected the attribution to not be spoken: %+v", body.OutputSpeech)
+			}
+		})
+	}
+}
+
+func TestPendingIntentNewSession(t *testing.T) {
+	tests := []struct {
+		name       string
+		newSession bool
+		expected   string
+	}{
+		{"same session", false, "Yard Waste is picked up weekly."},
+		{"new session", true, "Curbside pick up for yard waste is on Thursday June 24 and Thursday July 1."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "STREET_ADDRESS", "1260 NW Maynard Rd")
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-24", name: "yardwaste"},
+				serviceOccurrence{day: "2021-07-01", name: "yardwaste"},
+			))
+
+			// The pending intent of a prior session must not change the new session's answer
+			request := newIntentRequest("GetSchedule", map[string]string{"collectionType": "yard waste"})
+			request.Session.New = test.newSession
+			request.Session.Attributes = map[string]interface{}{"pendingIntent": "Frequency"}
+			answer, err := dispatchIntent(context.Background(), client, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestListScheduleRecap(t *testing.T) {
+	const longSchedule = "Next garbage is Monday June 21, next recycling is Monday June 21, next yard waste is " +
+		"Thursday June 24, and next leaf collection is Friday June 25."
+
+	tests := []struct {
+		name            string
+		serviceNames    string
+		recapMinPhrases string
+		expected        string
+	}{
+		{
+			"long schedule", "", "",
+			longSchedule + " In short, garbage is weekly on Mondays, recycling is every two weeks on Mondays, " +
+				"and yard waste is weekly on Thursdays.",
+		},
+		{
+			"short schedule", "Garbage,Recycling", "",
+			"Next garbage is Monday June 21 and next recycling is Monday June 21.",
+		},
+		{
+			"short schedule with a lower minimum", "Garbage,Recycling", "2",
+			"Next garbage is Monday June 21 and next recycling is Monday June 21. In short, garbage is weekly " +
+				"on Mondays and recycling is every two weeks on Mondays.",
+		},
+		{"higher minimum", "", "5", longSchedule},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "SERVICE_NAMES", test.serviceNames)
+			setenv(t, "RECAP_MIN_PHRASES", test.recapMinPhrases)
+			setNow(t, time.Date(2021, 6, 20, 16, 0, 0, 0, time.UTC))
+			client := newTestRecollect(t, eventsHandler(
+				serviceOccurrence{day: "2021-06-21", name: "Garbage"},
+				serviceOccurrence{day: "2021-06-21", name: "Recycling"},
+				serviceOccurrence{day: "2021-06-24", name: "yardwaste"},
+				serviceOccurrence{day: "2021-06-25", name: "looseleaf"},
+				serviceOccurrence{day: "2021-06-28", name: "Garbage"},
+				serviceOccurrence{day: "2021-07-01", name: "yardwaste"},
+				serviceOccurrence{day: "2021-07-05", name: "Garbage"},
+				serviceOccurrence{day: "2021-07-05", name: "Recycling"},
+				serviceOccurrence{day: "2021-07-08", name: "yardwaste"},
+				serviceOccurrence{day: "2021-07-12", name: "Garbage"},
+			))
+
+			answer, err := handleListSchedule(context.Background(), client, "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
+
+func TestScheduleRecap(t *testing.T) {
+	// Leaf collection is irregular and yard waste only has one day, so neither has a cadence
+	occurrences := []serviceOccurrence{
+		{day: "2021-06-21", name: "Garbage"},
+		{day: "2021-06-22", name: "looseleaf"},
+		{day: "2021-06-24", name: "yardwaste"},
+		{day: "2021-06-25", name: "looseleaf"},
+		{day: "2021-06-28", name: "Garbage"},
+		{day: "2021-07-05", name: "looseleaf"},
+	}
+	if recap, expected := scheduleRecap(occurrences), "In short, garbage is weekly on Mondays."; recap != expected {
+		t.Errorf("expected %q, got %q", expected, recap)
+	}
+
+	irregular := []serviceOccurrence{occurrences[1], occurrences[2], occurrences[3], occurrences[5]}
+	if recap := scheduleRecap(irregular); recap != "" {
+		t.Errorf("expected no recap without a regular cadence, got %q", recap)
+	}
+}
+
+func TestMissedPickupWeekStart(t *testing.T) {
+	tests := []struct {
+		weekStart string
+		after     string
+		expected  string
+	}{
+		{"", "2021-06-27", "No, garbage is still coming up tomorrow."},
+		{"sunday", "2021-06-27", "No, garbage is still coming up tomorrow."},
+		{"monday", "2021-06-21", "Yes, garbage was collected Monday."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.weekStart, func(t *testing.T) {
+			setenv(t, "TIME_ZONE", "America/New_York")
+			setenv(t, "WEEK_START", test.weekStart)
+			// Sunday is the last day of the week when it starts on Monday
+			setNow(t, time.Date(2021, 6, 27, 16, 0, 0, 0, time.UTC))
+
+			var eventsQuery url.Values
+			client := newTestRecollect(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/address-suggest") {
+					w.Write([]byte(`[{"place_id": "ABC123"}]`))
+					return
+				}
+				// Only respond with the days in the requested week
+				eventsQuery = r.URL.Query()
+				var events []recollect.Event
+				for _, day := range []string{"2021-06-21", "2021-06-28"} {
+					if day >= eventsQuery.Get("after") && day < eventsQuery.Get("before") {
+						events = append(events, recollect.Event{
+							Day: day, Flags: []recollect.Flag{{Name: "Garbage", ServiceName: "waste"}},
+						})
+					}
+				}
+				json.NewEncoder(w).Encode(recollect.EventJSON{Events: events})
+			})
+
+			answer, err := handleMissedPickup(context.Background(), client, "1260 NW Maynard Rd", "garbage")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if eventsQuery.Get("after") != test.after {
+				t.Errorf("expected the week to start on %s, got %v", test.after, eventsQuery)
+			}
+			if answer.Speech != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, answer.Speech)
+			}
+		})
+	}
+}
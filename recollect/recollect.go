@@ -0,0 +1,201 @@
+// Package recollect is a client of the recollect API, which provides the
+// curbside pick up schedules of many municipalities.
+package recollect
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrAddressNotFound is returned when recollect has no place for the address
+var ErrAddressNotFound = errors.New("the address wasn't found")
+
+// Doer sends HTTP requests. This is satisfied by *http.Client.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Client queries the recollect API for an area and service
+type Client struct {
+	// HTTPClient sends the HTTP requests
+	HTTPClient Doer
+	// BaseURL is the URL of the recollect API (e.g. https://api.recollect.net)
+	BaseURL string
+	// Area is the recollect area of the addresses (e.g. CaryNC)
+	Area string
+	// ServiceID is the recollect service ID (e.g. 1087)
+	ServiceID string
+}
+
+// AddressItem is an address in the address-suggest response
+type AddressItem struct {
+	// The place ID is kept raw since it's a JSON number in some areas
+	PlaceID json.RawMessage `json:"place_id"`
+}
+
+// Flag describes what an event is (e.g. a garbage pick up)
+type Flag struct {
+	Name        string
+	ServiceName string `json:"service_name"`
+}
+
+// Event is a day in the schedule of a place
+type Event struct {
+	Day         string // Format is in 2021-06-22
+	Title       string
+	Description string
+	Flags       []Flag
+}
+
+// EventJSON is the events response
+type EventJSON struct {
+	Events []Event
+}
+
+// AddressID returns the place ID of the street address (e.g. 1260 NW Maynard
+// Rd). The first suggested address is used since it's the most accurate. The
+// address is personal information, so it's never logged or in the errors.
+func (c *Client) AddressID(ctx context.Context, address string) (string, error) {
+	suggestURL := fmt.Sprintf("%s/api/areas/%s/services/%s/address-suggest", c.BaseURL, c.Area, c.ServiceID)
+	log.Printf("Making an HTTP request at %s", suggestURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, suggestURL+"?q="+url.QueryEscape(address), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		// The url.Error has the URL with the address
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = suggestURL
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("The address lookup HTTP request failed with %s", resp.Status)
+		return "", fmt.Errorf("failed to find the address: %s", resp.Status)
+	}
+
+	body, err := ReadBody(resp)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the address: %v", err)
+	}
+
+	addresses := []AddressItem{}
+	err = json.Unmarshal(body, &addresses)
+	if err != nil {
+		log.Printf("Failed to unmarshall the address lookup response: %v", err)
+		return "", fmt.Errorf("failed to unmarshall the response: %v", err)
+	}
+
+	if len(addresses) == 0 {
+		log.Print("The address wasn't found")
+		return "", ErrAddressNotFound
+	}
+
+	placeID := addresses[0].ID()
+	if placeID == "" {
+		log.Print("The address doesn't have a place ID")
+		return "", ErrAddressNotFound
+	}
+	log.Printf("Found the address ID of %s", placeID)
+	return placeID, nil
+}
+
+// ID returns the place ID as an opaque string. The place ID can be a JSON
+// string (e.g. a UUID) or a JSON number, which is returned as is rather than
+// parsed so that large IDs aren't rounded. This is empty if there is no place ID.
+func (a AddressItem) ID() string {
+	var placeID string
+	if err := json.Unmarshal(a.PlaceID, &placeID); err == nil {
+		return strings.TrimSpace(placeID)
+	}
+
+	var number json.Number
+	if err := json.Unmarshal(a.PlaceID, &number); err == nil {
+		return number.String()
+	}
+
+	return ""
+}
+
+// Schedule returns the events of the place ID between the after and before
+// days
+func (c *Client) Schedule(ctx context.Context, placeID string, after time.Time, before time.Time) ([]Event, error) {
+	// The place ID is opaque (e.g. numeric, a UUID, or base64) and is only escaped
+	placePath := url.PathEscape(placeID)
+	url := fmt.Sprintf(
+		"%s/api/places/%s/services/%s/events?nomerge=1&hide=reminder_only&after=%s&before=%s",
+		c.BaseURL, placePath, c.ServiceID, after.Format("2006-01-02"), before.Format("2006-01-02"),
+	)
+	log.Printf("Making an HTTP request at %s", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		// The url.Error includes the URL that failed
+		log.Printf("The schedule lookup HTTP request failed: %v", err)
+		return nil, fmt.Errorf("failed to get the schedule: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		log.Print("The schedule lookup response has no content, so there are no events")
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("The schedule lookup failed with %s", resp.Status)
+		return nil, fmt.Errorf("failed to get the schedule: %s", resp.Status)
+	}
+
+	body, err := ReadBody(resp)
+	if err != nil {
+		return nil, errors.New("failed to get the schedule")
+	}
+
+	var rvJSON EventJSON
+	err = json.Unmarshal(body, &rvJSON)
+	if err != nil {
+		// Some variants of the events endpoint return the events as a bare array
+		arrayErr := json.Unmarshal(body, &rvJSON.Events)
+		if arrayErr != nil {
+			log.Printf("Failed to unmarshall the schedule lookup response: %v", err)
+			return nil, fmt.Errorf("failed to unmarshall the response: %v", err)
+		}
+		log.Print("The schedule lookup response is a bare array of events")
+	}
+
+	return rvJSON.Events, nil
+}
+
+// ReadBody returns the body of the HTTP response. The body is decompressed if
+// it's gzip encoded and the HTTP transport didn't already decompress it, which
+// happens when a server or CDN compresses a response that wasn't requested that
+// way.
+func ReadBody(resp *http.Response) ([]byte, error) {
+	if resp.Uncompressed || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return io.ReadAll(resp.Body)
+	}
+
+	gzipReader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	return io.ReadAll(gzipReader)
+}
@@ -0,0 +1,211 @@
+package recollect
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client of a test recollect API served by the handler
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &Client{HTTPClient: server.Client(), BaseURL: server.URL, Area: "CaryNC", ServiceID: "1087"}
+}
+
+func TestAddressID(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/areas/CaryNC/services/1087/address-suggest" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if q := r.URL.Query().Get("q"); q != "1260 NW Maynard Rd" {
+			t.Errorf("unexpected address query %q", q)
+		}
+		w.Write([]byte(`[{"place_id": "ABC123"}, {"place_id": "DEF456"}]`))
+	})
+
+	placeID, err := client.AddressID(context.Background(), "1260 NW Maynard Rd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if placeID != "ABC123" {
+		t.Errorf("expected the first suggested place ID ABC123, got %s", placeID)
+	}
+}
+
+func TestAddressIDErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		errMsg string
+	}{
+		{"address not found", http.StatusOK, `[]`, "the address wasn't found"},
+		{"non-200", http.StatusBadGateway, ``, "failed to find the address: 502 Bad Gateway"},
+		{"malformed JSON", http.StatusOK, `[{"place_id": `, "failed to unmarshall the response"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			})
+
+			placeID, err := client.AddressID(context.Background(), "1260 NW Maynard Rd")
+			if err == nil {
+				t.Fatalf("expected an error, got the place ID %s", placeID)
+			}
+			if !strings.Contains(err.Error(), test.errMsg) {
+				t.Errorf("expected the error to contain %q, got %q", test.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestScheduleResponseShapes(t *testing.T) {
+	events := `[{"day": "2021-06-21", "flags": [{"name": "Garbage", "service_name": "waste"}]}]`
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"object", `{"events": ` + events + `}`},
+		{"bare array", events},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(test.body))
+			})
+
+			after := time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)
+			schedule, err := client.Schedule(context.Background(), "ABC123", after, after.AddDate(0, 0, 30))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expected := []Event{{Day: "2021-06-21", Flags: []Flag{{Name: "Garbage", ServiceName: "waste"}}}}
+			if !reflect.DeepEqual(schedule, expected) {
+				t.Errorf("expected the events %+v, got %+v", expected, schedule)
+			}
+		})
+	}
+}
+
+func TestScheduleNoContent(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	after := time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)
+	schedule, err := client.Schedule(context.Background(), "ABC123", after, after.AddDate(0, 0, 30))
+	if err != nil {
+		t.Fatalf("expected an empty schedule rather than an error, got: %v", err)
+	}
+	if len(schedule) != 0 {
+		t.Errorf("expected no events, got %+v", schedule)
+	}
+}
+
+func TestScheduleGzipResponse(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// Compress the response even though it wasn't requested like some CDNs do
+		w.Header().Set("Content-Encoding", "gzip")
+		gzipWriter := gzip.NewWriter(w)
+		gzipWriter.Write([]byte(`{"events": [{"day": "2021-06-21", "flags": [{"name": "Garbage", "service_name": "waste"}]}]}`))
+		gzipWriter.Close()
+	})
+	// Keep the HTTP transport from requesting and transparently decompressing gzip
+	client.HTTPClient = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	after := time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)
+	schedule, err := client.Schedule(context.Background(), "ABC123", after, after.AddDate(0, 0, 30))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(schedule) != 1 || schedule[0].Day != "2021-06-21" {
+		t.Errorf("expected the gzip encoded event on 2021-06-21, got %+v", schedule)
+	}
+}
+
+func TestOpaquePlaceIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		placeID string
+	}{
+		{"UUID", "2d0e4f5a-8c3b-4b7e-9f21-6a1d3c5e7b90"},
+		{"base64", "b3BhcXVlK2lkLz0/x+Y="},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			eventsPath := "/api/places/" + url.PathEscape(test.placeID) + "/services/1087/events"
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/address-suggest") {
+					fmt.Fprintf(w, `[{"place_id": %q}]`, test.placeID)
+					return
+				}
+
+				if r.URL.EscapedPath() != eventsPath {
+					t.Errorf("expected the events path %s, got %s", eventsPath, r.URL.EscapedPath())
+				}
+				w.Write([]byte(`{"events": []}`))
+			})
+
+			placeID, err := client.AddressID(context.Background(), "1260 NW Maynard Rd")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if placeID != test.placeID {
+				t.Fatalf("expected the place ID %s, got %s", test.placeID, placeID)
+			}
+
+			after := time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)
+			if _, err := client.Schedule(context.Background(), placeID, after, after.AddDate(0, 0, 30)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAddressItemNumericID(t *testing.T) {
+	// A large numeric place ID must not be rounded by parsing it as a float
+	item := AddressItem{PlaceID: json.RawMessage(`12345678901234567890`)}
+	if placeID := item.ID(); placeID != "12345678901234567890" {
+		t.Errorf("expected the place ID 12345678901234567890, got %s", placeID)
+	}
+}
+
+// failingDoer is a Doer whose HTTP requests fail like an unreachable server
+type failingDoer struct{}
+
+// Do fails the HTTP request with a url.Error like http.Client
+func (failingDoer) Do(req *http.Request) (*http.Response, error) {
+	return nil, &url.Error{Op: "Get", URL: req.URL.String(), Err: errors.New("connection refused")}
+}
+
+func TestAddressIDErrorOmitsAddress(t *testing.T) {
+	client := &Client{HTTPClient: failingDoer{}, BaseURL: "https://api.recollect.net", Area: "CaryNC", ServiceID: "1087"}
+
+	_, err := client.AddressID(context.Background(), "1260 NW Maynard Rd")
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		t.Fatalf("expected a url.Error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "Maynard") {
+		t.Errorf("expected the error to not have the address: %v", err)
+	}
+}